@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Bootstrapper forms a new cluster from a static list of peers, by notifying
+// every peer of this node until the cluster has been bootstrapped.
+type Bootstrapper struct {
+	// Interval is the time to wait between notifying every peer.
+	Interval time.Duration
+
+	// Token, if set, is the API token presented to the peers.
+	Token string
+
+	client *http.Client
+	scheme string
+	logger *log.Logger
+}
+
+// NewBootstrapper returns a Bootstrapper which notifies every peer at the
+// given interval. If tlsConfig is not nil, peers are notified over HTTPS
+// using it.
+func NewBootstrapper(interval time.Duration, tlsConfig *tls.Config) *Bootstrapper {
+	client, scheme := newClient(tlsConfig)
+	return &Bootstrapper{
+		Interval: interval,
+		client:   client,
+		scheme:   scheme,
+		logger:   log.New(os.Stderr, "[bootstrap] ", log.LstdFlags),
+	}
+}
+
+// notifyRequest is the body of a notify request.
+type notifyRequest struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	HTTPAddr string `json:"http_addr"`
+}
+
+// Boot notifies the peers looked up with d that the node identified by nodeID,
+// with Raft reachable at raftAddr and its HTTP API at httpAddr, is waiting to
+// bootstrap the cluster. Every peer is notified repeatedly, since peers may not
+// be running yet, until done returns true. The peers are looked up again every
+// time. An error is returned if done has not returned true before timeout.
+func (b *Bootstrapper) Boot(d Discoverer, nodeID, raftAddr, httpAddr string, done func() bool, timeout time.Duration) error {
+	body, err := json.Marshal(notifyRequest{ID: nodeID, Addr: raftAddr, HTTPAddr: httpAddr})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		peers, err := d.Lookup()
+		if err != nil {
+			b.logger.Printf("failed to discover peers: %s", err)
+		}
+		for _, addr := range peers {
+			if err := b.notify(addr, body); err != nil {
+				b.logger.Printf("failed to notify %s: %s", addr, err)
+			}
+		}
+		if done() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cluster not bootstrapped after %s", timeout)
+		}
+		time.Sleep(b.Interval)
+	}
+}
+
+// notify makes a single notify request to the node at the given address.
+func (b *Bootstrapper) notify(addr string, body []byte) error {
+	resp, err := post(b.client, fmt.Sprintf("%s://%s/notify", b.scheme, addr), b.Token, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
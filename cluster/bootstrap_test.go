@@ -0,0 +1,58 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test_Boot tests that every peer is notified until the cluster is
+// bootstrapped.
+func Test_Boot(t *testing.T) {
+	var mu sync.Mutex
+	notified := make(map[string]int)
+	newPeer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req notifyRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID != "node0" || req.Addr != "localhost:12000" || req.HTTPAddr != "localhost:11000" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			notified[name]++
+			mu.Unlock()
+		}))
+	}
+	p1, p2 := newPeer("p1"), newPeer("p2")
+	defer p1.Close()
+	defer p2.Close()
+
+	rounds := 0
+	done := func() bool {
+		rounds++
+		return rounds == 3
+	}
+	b := NewBootstrapper(10*time.Millisecond, nil)
+	peers := StaticDiscoverer{p1.Listener.Addr().String(), p2.Listener.Addr().String()}
+	if err := b.Boot(peers, "node0", "localhost:12000", "localhost:11000", done, time.Minute); err != nil {
+		t.Fatalf("failed to boot: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if notified["p1"] != 3 || notified["p2"] != 3 {
+		t.Fatalf("wrong number of notifications: %v", notified)
+	}
+}
+
+// Test_BootTimeout tests that an error is returned if the cluster is not
+// bootstrapped in time.
+func Test_BootTimeout(t *testing.T) {
+	b := NewBootstrapper(10*time.Millisecond, nil)
+	err := b.Boot(StaticDiscoverer{"127.0.0.1:1"}, "node0", "localhost:12000", "localhost:11000", func() bool { return false }, 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("boot succeeded unexpectedly")
+	}
+}
@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dnsLookupTimeout = 5 * time.Second
+
+// Discoverer discovers the nodes with which to form, or join, a cluster.
+type Discoverer interface {
+	// Lookup returns the addresses of the HTTP APIs of the nodes currently
+	// known to the discoverer. It is called again on every attempt, so the
+	// nodes returned may change over time.
+	Lookup() ([]string, error)
+}
+
+// StaticDiscoverer is a Discoverer which always returns the same addresses.
+type StaticDiscoverer []string
+
+// Lookup implements Discoverer.
+func (d StaticDiscoverer) Lookup() ([]string, error) {
+	return append([]string(nil), d...), nil
+}
+
+// Resolver resolves DNS names. It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSDiscoverer is a Discoverer which resolves a DNS name to the nodes.
+type DNSDiscoverer struct {
+	// Name is the DNS name to resolve.
+	Name string
+
+	// SRV, if set, causes Name to be resolved as an SRV record, which gives
+	// the host and port of every node. Otherwise Name is resolved to A or
+	// AAAA records, and Port is used for every node.
+	SRV  bool
+	Port int
+
+	// Resolver resolves Name. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+}
+
+// Lookup implements Discoverer. The addresses are returned in order.
+func (d *DNSDiscoverer) Lookup() ([]string, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	var addrs []string
+	if d.SRV {
+		_, srvs, err := r.LookupSRV(ctx, "", "", d.Name)
+		if err != nil {
+			return nil, fmt.Errorf("lookup SRV %s: %s", d.Name, err)
+		}
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	} else {
+		hosts, err := r.LookupHost(ctx, d.Name)
+		if err != nil {
+			return nil, fmt.Errorf("lookup %s: %s", d.Name, err)
+		}
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(d.Port)))
+		}
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// FileDiscoverer is a Discoverer which reads the nodes from a file, holding a
+// JSON array of the addresses of their HTTP APIs. The file is read on every
+// lookup, so it may be changed at any time.
+type FileDiscoverer struct {
+	Path string
+}
+
+// Lookup implements Discoverer.
+func (d *FileDiscoverer) Lookup() ([]string, error) {
+	b, err := os.ReadFile(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	if err := json.Unmarshal(b, &addrs); err != nil {
+		return nil, fmt.Errorf("parse %s: %s", d.Path, err)
+	}
+	return addrs, nil
+}
+
+// Watch checks the file for changes at the given interval, and calls f after
+// every change to its contents, until done is closed. The file need not exist
+// when Watch is called.
+func (d *FileDiscoverer) Watch(interval time.Duration, done <-chan struct{}, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := os.ReadFile(d.Path)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		b, _ := os.ReadFile(d.Path)
+		if bytes.Equal(b, last) {
+			continue
+		}
+		last = b
+		f()
+	}
+}
@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stubResolver resolves names from fixed records.
+type stubResolver struct {
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if srvs, ok := r.srvs[name]; ok {
+		return name, srvs, nil
+	}
+	return "", nil, errors.New("no such host")
+}
+
+// Test_DNSDiscoverer tests that nodes are discovered from A and SRV records.
+func Test_DNSDiscoverer(t *testing.T) {
+	r := &stubResolver{
+		hosts: map[string][]string{
+			"hraftd.local": {"10.0.0.2", "10.0.0.1", "fd00::1"},
+		},
+		srvs: map[string][]*net.SRV{
+			"_hraftd._tcp.local": {
+				{Target: "node1.local.", Port: 11001},
+				{Target: "node0.local.", Port: 11000},
+			},
+		},
+	}
+
+	d := &DNSDiscoverer{Name: "hraftd.local", Port: 11000, Resolver: r}
+	addrs, err := d.Lookup()
+	if err != nil {
+		t.Fatalf("failed to look up A records: %s", err)
+	}
+	if exp := []string{"10.0.0.1:11000", "10.0.0.2:11000", "[fd00::1]:11000"}; !reflect.DeepEqual(addrs, exp) {
+		t.Fatalf("wrong addresses from A records, exp %v, got %v", exp, addrs)
+	}
+
+	d = &DNSDiscoverer{Name: "_hraftd._tcp.local", SRV: true, Resolver: r}
+	addrs, err = d.Lookup()
+	if err != nil {
+		t.Fatalf("failed to look up SRV records: %s", err)
+	}
+	if exp := []string{"node0.local:11000", "node1.local:11001"}; !reflect.DeepEqual(addrs, exp) {
+		t.Fatalf("wrong addresses from SRV records, exp %v, got %v", exp, addrs)
+	}
+
+	d = &DNSDiscoverer{Name: "missing.local", Port: 11000, Resolver: r}
+	if _, err := d.Lookup(); err == nil {
+		t.Fatalf("lookup of missing name succeeded unexpectedly")
+	}
+}
+
+// Test_FileDiscoverer tests that nodes are discovered from a file, and that
+// changes to the file are noticed.
+func Test_FileDiscoverer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	d := &FileDiscoverer{Path: path}
+	if _, err := d.Lookup(); err == nil {
+		t.Fatalf("lookup of missing file succeeded unexpectedly")
+	}
+
+	if err := os.WriteFile(path, []byte(`[]`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go d.Watch(10*time.Millisecond, done, func() { changed <- struct{}{} })
+
+	// Give the watch time to read the file.
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(path, []byte(`["127.0.0.1:11000", "127.0.0.1:11001"]`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("file change not noticed")
+	}
+	addrs, err := d.Lookup()
+	if err != nil {
+		t.Fatalf("failed to look up file: %s", err)
+	}
+	if exp := []string{"127.0.0.1:11000", "127.0.0.1:11001"}; !reflect.DeepEqual(addrs, exp) {
+		t.Fatalf("wrong addresses from file, exp %v, got %v", exp, addrs)
+	}
+
+	if err := os.WriteFile(path, []byte(`not json`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("file change not noticed")
+	}
+	if _, err := d.Lookup(); err == nil {
+		t.Fatalf("lookup of invalid file succeeded unexpectedly")
+	}
+}
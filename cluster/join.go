@@ -0,0 +1,157 @@
+// Package cluster provides the client side of cluster membership, allowing a
+// node to join an existing cluster, or to bootstrap a new one with its peers.
+package cluster
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const maxJoinInterval = 30 * time.Second
+
+// Joiner joins a node to an existing cluster, through the HTTP API of any of
+// the cluster's nodes.
+type Joiner struct {
+	// Attempts is the number of times every address is tried before the
+	// join fails.
+	Attempts int
+
+	// Interval is the time to wait after the first failed attempt. It is
+	// doubled after every further attempt, up to a maximum of 30 seconds.
+	Interval time.Duration
+
+	// Token, if set, is the API token presented to the cluster.
+	Token string
+
+	client *http.Client
+	scheme string
+	logger *log.Logger
+}
+
+// NewJoiner returns a Joiner which makes the given number of attempts, waiting
+// initially for the given interval between them. If tlsConfig is not nil,
+// requests are made over HTTPS using it.
+func NewJoiner(attempts int, interval time.Duration, tlsConfig *tls.Config) *Joiner {
+	client, scheme := newClient(tlsConfig)
+	return &Joiner{
+		Attempts: attempts,
+		Interval: interval,
+		client:   client,
+		scheme:   scheme,
+		logger:   log.New(os.Stderr, "[join] ", log.LstdFlags),
+	}
+}
+
+// joinRequest is the body of a join request.
+type joinRequest struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	HTTPAddr string `json:"http_addr"`
+	Voter    bool   `json:"voter"`
+}
+
+// Join requests that the node, identified by nodeID and with Raft reachable at
+// raftAddr, joins the cluster. The nodes in the cluster are looked up with d on
+// every attempt, and tried in turn until one succeeds. A node which is not the
+// leader forwards the request, or redirects it, to the leader. The address
+// which accepted the join is returned.
+func (j *Joiner) Join(d Discoverer, nodeID, raftAddr, httpAddr string, voter bool) (string, error) {
+	b, err := json.Marshal(joinRequest{ID: nodeID, Addr: raftAddr, HTTPAddr: httpAddr, Voter: voter})
+	if err != nil {
+		return "", err
+	}
+
+	attempts := max(j.Attempts, 1)
+	interval := j.Interval
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			j.logger.Printf("failed to join cluster, retrying in %s", interval)
+			time.Sleep(interval)
+			interval *= 2
+			if interval > maxJoinInterval {
+				interval = maxJoinInterval
+			}
+		}
+
+		var joinAddrs []string
+		joinAddrs, err = d.Lookup()
+		if err == nil && len(joinAddrs) == 0 {
+			err = fmt.Errorf("no join addresses")
+		}
+		if err != nil {
+			j.logger.Printf("failed to discover nodes: %s", err)
+			continue
+		}
+		for _, addr := range joinAddrs {
+			if err = j.join(addr, b); err == nil {
+				return addr, nil
+			}
+			j.logger.Printf("failed to join cluster at %s: %s", addr, err)
+		}
+	}
+	return "", fmt.Errorf("failed to join cluster after %d attempts: %s", attempts, err)
+}
+
+// join makes a single join request to the node at the given address. The
+// client follows redirects to the leader, sending the body again.
+func (j *Joiner) join(addr string, body []byte) error {
+	resp, err := post(j.client, fmt.Sprintf("%s://%s/join", j.scheme, addr), j.Token, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// post makes a POST request with the given JSON body, presenting token if it is
+// set.
+func post(client *http.Client, url, token string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return client.Do(req)
+}
+
+// newClient returns an HTTP client for making requests to other nodes, and the
+// URL scheme to use. If tlsConfig is not nil, requests are made over HTTPS.
+func newClient(tlsConfig *tls.Config) (*http.Client, string) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		// The token is sent again when redirected to the leader, which the
+		// client otherwise only does for redirects to the same host.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if auth := via[0].Header.Get("Authorization"); auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			return nil
+		},
+	}
+	if tlsConfig == nil {
+		return client, "http"
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	return client, "https"
+}
@@ -0,0 +1,121 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test_JoinRetry tests that a join is retried across addresses until one
+// succeeds.
+func Test_JoinRetry(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var req joinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.ID != "node1" || req.Addr != "localhost:12001" || req.HTTPAddr != "localhost:11001" || !req.Voter {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}))
+	defer ts.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	downAddr := down.Listener.Addr().String()
+	down.Close()
+
+	j := NewJoiner(3, 10*time.Millisecond, nil)
+	addr, err := j.Join(StaticDiscoverer{downAddr, ts.Listener.Addr().String()}, "node1", "localhost:12001", "localhost:11001", true)
+	if err != nil {
+		t.Fatalf("failed to join: %s", err)
+	}
+	if addr != ts.Listener.Addr().String() {
+		t.Fatalf("joined via wrong address: %s", addr)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("wrong number of join requests: %d", n)
+	}
+}
+
+// Test_JoinRedirect tests that a join follows a redirect to the leader, on
+// another host, presenting the token again.
+func Test_JoinRedirect(t *testing.T) {
+	var joined int32
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req joinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID != "node1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&joined, 1)
+	}))
+	defer leader.Close()
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaderURL := strings.Replace(leader.URL, "127.0.0.1", "localhost", 1)
+		http.Redirect(w, r, leaderURL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer follower.Close()
+
+	j := NewJoiner(1, 0, nil)
+	j.Token = "secret"
+	if _, err := j.Join(StaticDiscoverer{follower.Listener.Addr().String()}, "node1", "localhost:12001", "", true); err != nil {
+		t.Fatalf("failed to join: %s", err)
+	}
+	if atomic.LoadInt32(&joined) != 1 {
+		t.Fatalf("join not received by leader")
+	}
+}
+
+// Test_JoinFail tests that a join which never succeeds returns an error
+// describing the last failure.
+func Test_JoinFail(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	j := NewJoiner(2, 10*time.Millisecond, nil)
+	_, err := j.Join(StaticDiscoverer{ts.Listener.Addr().String()}, "node1", "localhost:12001", "", true)
+	if err == nil {
+		t.Fatalf("join succeeded unexpectedly")
+	}
+	if !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "not ready") {
+		t.Fatalf("wrong error: %s", err)
+	}
+
+	if _, err := j.Join(StaticDiscoverer{}, "node1", "localhost:12001", "", true); err == nil {
+		t.Fatalf("join with no addresses succeeded unexpectedly")
+	}
+}
+
+// Test_JoinTLS tests that a join can be made over HTTPS.
+func Test_JoinTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	tlsConfig := ts.Client().Transport.(*http.Transport).TLSClientConfig
+	j := NewJoiner(1, 0, tlsConfig)
+	if _, err := j.Join(StaticDiscoverer{ts.Listener.Addr().String()}, "node1", "localhost:12001", "", true); err != nil {
+		t.Fatalf("failed to join over HTTPS: %s", err)
+	}
+
+	j = NewJoiner(1, 0, nil)
+	if _, err := j.Join(StaticDiscoverer{ts.Listener.Addr().String()}, "node1", "localhost:12001", "", true); err == nil {
+		t.Fatalf("joined HTTPS server over HTTP")
+	}
+}
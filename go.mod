@@ -5,8 +5,10 @@ go 1.21
 toolchain go1.23.3
 
 require (
+	github.com/google/btree v1.1.3
 	github.com/hashicorp/raft v1.7.0
 	github.com/hashicorp/raft-boltdb/v2 v2.3.0
+	golang.org/x/crypto v0.24.0
 )
 
 require (
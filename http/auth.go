@@ -0,0 +1,210 @@
+package httpd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	store "github.com/otoolep/hraftd/store"
+)
+
+// aclKey is the context key of the ACL of an authenticated request.
+type aclKey struct{}
+
+// authenticate returns the ACL of the token, or the user, which the request
+// carries in its Authorization header. ok is false if there is no token or
+// user, or it is not valid.
+func (s *Service) authenticate(r *http.Request) (acl store.ACL, ok bool) {
+	if name, password, found := r.BasicAuth(); found {
+		return s.store.AuthenticateUser(name, password)
+	}
+	secret, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || secret == "" {
+		return store.ACL{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.RootToken)) == 1 {
+		return store.ACL{Admin: true}, true
+	}
+	return s.store.AuthenticateToken(secret)
+}
+
+// requestACL returns the ACL of the request. Every request is allowed
+// everything if authentication is not required.
+func requestACL(r *http.Request) store.ACL {
+	if acl, ok := r.Context().Value(aclKey{}).(store.ACL); ok {
+		return acl
+	}
+	return store.ACL{Admin: true}
+}
+
+// withACL returns the request, carrying the given ACL.
+func withACL(r *http.Request, acl store.ACL) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), aclKey{}, acl))
+}
+
+// authorized returns whether the ACL allows the request. Requests which may
+// touch several keys, writes to several keys and transactions, are allowed
+// here, and the keys are checked by their handlers. Requests for a single key
+// whose path does not name exactly one key are only allowed for admins.
+func authorized(acl store.ACL, r *http.Request) bool {
+	switch {
+	case r.URL.Path == "/keys":
+		return acl.CanRead(r.URL.Query().Get("prefix"))
+	case r.URL.Path == "/key":
+		return true
+	case strings.HasPrefix(r.URL.Path, "/key"):
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 3 || parts[2] == "" {
+			return acl.Admin
+		}
+		if r.Method == "GET" {
+			return acl.CanRead(parts[2])
+		}
+		return acl.CanWrite(parts[2])
+	case strings.HasPrefix(r.URL.Path, "/watch/"):
+		return acl.CanRead(strings.TrimPrefix(r.URL.Path, "/watch/"))
+	case r.URL.Path == "/txn", r.URL.Path == "/status", r.URL.Path == "/stats":
+		return true
+	default:
+		return acl.Admin
+	}
+}
+
+// tokenRequest is the body of a request to create a token.
+type tokenRequest struct {
+	Name string `json:"name"`
+	store.ACL
+}
+
+// tokenResponse is the body of the response to creating a token. Token is the
+// secret, which cannot be retrieved again.
+type tokenResponse struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+func (s *Service) handleTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		b, err := json.Marshal(s.store.Tokens())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+
+	case "POST":
+		var req tokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		secret, err := s.store.CreateToken(req.Name, req.ACL)
+		if errors.Is(err, store.ErrTokenExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(tokenResponse{Name: req.Name, Token: secret})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+
+	case "DELETE":
+		name := strings.TrimPrefix(r.URL.Path, "/tokens/")
+		if name == "" || name == r.URL.Path {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err := s.store.DeleteToken(name)
+		if errors.Is(err, store.ErrTokenNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// userRequest is the body of a request to set a user.
+type userRequest struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+func (s *Service) handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		b, err := json.Marshal(s.store.Users())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+
+	case "POST":
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// bcrypt only uses the first 72 bytes of a password.
+		if req.Name == "" || req.Password == "" || len(req.Password) > 72 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err := s.store.SetUser(req.Name, req.Password, req.Roles)
+		if errors.Is(err, store.ErrInvalidRole) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+	case "DELETE":
+		name := strings.TrimPrefix(r.URL.Path, "/users/")
+		if name == "" || name == r.URL.Path {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err := s.store.DeleteUser(name)
+		if errors.Is(err, store.ErrUserNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -3,14 +3,36 @@
 package httpd
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	store "github.com/otoolep/hraftd/store"
+	"github.com/otoolep/hraftd/tlsutil"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	defaultWatchWait = 30 * time.Second
+
+	// shutdownTimeout is how long Close waits for in-flight requests.
+	shutdownTimeout = 10 * time.Second
+
+	// forwardedHeader is set on requests forwarded to the leader, so they
+	// are never forwarded again.
+	forwardedHeader = "X-Hraftd-Forwarded"
 )
 
 // Store is the interface Raft-backed key-value stores must implement.
@@ -18,23 +40,159 @@ type Store interface {
 	// Get returns the value for the given key.
 	Get(key string) (string, error)
 
+	// GetKeyValue returns the value for the given key, along with its
+	// revision metadata. ok is false if the key does not exist.
+	GetKeyValue(key string) (kv store.KeyValue, ok bool, err error)
+
+	// GetWithLevel returns the value for the given key, along with its
+	// revision metadata, once the given read consistency level has been met.
+	GetWithLevel(key string, level store.ConsistencyLevel) (kv store.KeyValue, ok bool, err error)
+
+	// List returns, in order, at most limit keys which have the given prefix
+	// and fall within the range [start, end).
+	List(prefix, start, end string, limit int) ([]store.KeyValue, error)
+
 	// Set sets the value for the given key, via distributed consensus.
 	Set(key, value string) error
 
+	// SetMulti sets the values for all the given keys, atomically, via
+	// distributed consensus.
+	SetMulti(m map[string]string) error
+
+	// SetWithTTL sets the value for the given key, via distributed consensus,
+	// and deletes the key once ttl has elapsed.
+	SetWithTTL(key, value string, ttl time.Duration) error
+
+	// CompareAndSwap sets the value for the given key, via distributed
+	// consensus, but only if the current value of the key is prevValue.
+	CompareAndSwap(key, prevValue, value string) error
+
+	// CompareAndSwapVersion sets the value for the given key, via distributed
+	// consensus, but only if the current version of the key is prevVersion.
+	CompareAndSwapVersion(key string, prevVersion uint64, value string) error
+
 	// Delete removes the given key, via distributed consensus.
 	Delete(key string) error
 
+	// Txn atomically performs the given operations, via distributed
+	// consensus, if all the given compares hold.
+	Txn(compares []store.Compare, ops []store.Op) (store.TxnResult, error)
+
+	// Watch returns a watcher for changes to the given key, or to all keys
+	// with the given prefix if prefix is set, starting at the given log index.
+	Watch(key string, prefix bool, index uint64) (store.Watcher, error)
+
 	// Join joins the node, identitifed by nodeID and reachable at addr, to the cluster.
-	Join(nodeID string, addr string) error
+	// If voter is not set, the node joins as a non-voter.
+	Join(nodeID string, addr string, voter bool) error
+
+	// Notify records that the node, identified by nodeID and reachable at
+	// addr, with its HTTP API at httpAddr, is waiting to bootstrap the
+	// cluster.
+	Notify(nodeID string, addr string, httpAddr string) error
+
+	// TransferLeadership transfers leadership to the node identified by
+	// nodeID, or to any suitable node if nodeID is empty.
+	TransferLeadership(nodeID string) error
+
+	// Promote makes the non-voting node, identified by nodeID, a voter.
+	Promote(nodeID string) error
+
+	// Remove removes the node, identified by nodeID, from the cluster.
+	Remove(nodeID string) error
+
+	// SetNodeHTTPAddr records, via distributed consensus, the address of the
+	// HTTP API of the given node.
+	SetNodeHTTPAddr(nodeID, httpAddr string) error
+
+	// IsLeader returns whether this node is the leader of the cluster.
+	IsLeader() bool
+
+	// LeaderHTTPAddr returns the address of the HTTP API of the leader, or
+	// the empty string if it is not known.
+	LeaderHTTPAddr() string
 
 	// Show who is me, the leader, and followers
 	Status() (store.StoreStatus, error)
+
+	// Stats returns the Raft statistics of this node.
+	Stats() store.ServerStats
+
+	// CreateToken creates, via distributed consensus, a token with the given
+	// name and ACL, and returns its secret.
+	CreateToken(name string, acl store.ACL) (string, error)
+
+	// DeleteToken deletes, via distributed consensus, the token with the
+	// given name.
+	DeleteToken(name string) error
+
+	// Tokens returns every token, in name order.
+	Tokens() []store.Token
+
+	// AuthenticateToken returns the ACL of the token identified by the given
+	// secret. ok is false if there is no such token.
+	AuthenticateToken(secret string) (acl store.ACL, ok bool)
+
+	// SetUser creates, or updates, via distributed consensus, the user with
+	// the given name, password and roles.
+	SetUser(name, password string, roles []string) error
+
+	// DeleteUser deletes, via distributed consensus, the user with the given
+	// name.
+	DeleteUser(name string) error
+
+	// Users returns every user, in name order.
+	Users() []store.User
+
+	// AuthenticateUser returns the access granted to the user with the given
+	// name, if password is their password. ok is false otherwise.
+	AuthenticateUser(name, password string) (acl store.ACL, ok bool)
 }
 
 // Service provides HTTP service.
 type Service struct {
-	addr string
-	ln   net.Listener
+	// Redirect, if set, causes requests which only the leader can serve to
+	// be redirected to the leader, instead of being forwarded to it.
+	Redirect bool
+
+	// Certificate, if set, causes the service to serve HTTPS with this
+	// certificate, instead of HTTP. Every node must serve HTTPS if any does,
+	// since requests are forwarded, and redirected, to the leader using the
+	// same scheme. The certificate is also presented to the leader when
+	// forwarding.
+	Certificate *tlsutil.Certificate
+
+	// CAFile is the CA certificate which client certificates, and the
+	// leader's certificate when forwarding, are verified with. If empty, the
+	// system roots are used.
+	CAFile string
+
+	// VerifyClient, if set, requires clients to present a certificate signed
+	// by the CA.
+	VerifyClient bool
+
+	// RootToken, if set, requires every request to carry an API token, in
+	// an "Authorization: Bearer" header, or the credentials of a user, with
+	// HTTP basic authentication. RootToken is itself an admin token,
+	// which is not stored in the cluster. It must be the same on every node,
+	// since nodes use it to make requests of each other.
+	RootToken string
+
+	// Listener, if set, is where the service accepts connections, instead of
+	// listening on its address. It may be shared with Raft through a
+	// mux.Mux.
+	Listener net.Listener
+
+	addr   string
+	ln     net.Listener
+	server *http.Server
+
+	// proxyTransport is used to forward requests to the leader.
+	proxyTransport http.RoundTripper
+
+	// closing is closed when the service is closed, ending any watches.
+	closing   chan struct{}
+	closeOnce sync.Once
 
 	store Store
 }
@@ -42,28 +200,46 @@ type Service struct {
 // New returns an uninitialized HTTP service.
 func New(addr string, store Store) *Service {
 	return &Service{
-		addr:  addr,
-		store: store,
+		addr:    addr,
+		closing: make(chan struct{}),
+		store:   store,
 	}
 }
 
 // Start starts the service.
 func (s *Service) Start() error {
-	server := http.Server{
+	s.server = &http.Server{
 		Handler: s,
 	}
 
-	ln, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return err
+	ln := s.Listener
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", s.addr); err != nil {
+			return err
+		}
+	}
+	if s.Certificate != nil {
+		serverConfig, err := tlsutil.ServerConfig(s.Certificate, s.CAFile, s.VerifyClient)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		clientConfig, err := tlsutil.ClientConfig(s.Certificate, s.CAFile)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, serverConfig)
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = clientConfig
+		s.proxyTransport = transport
 	}
 	s.ln = ln
 
-	http.Handle("/", s)
-
 	go func() {
-		err := server.Serve(s.ln)
-		if err != nil {
+		err := s.server.Serve(s.ln)
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP serve: %s", err)
 		}
 	}()
@@ -71,54 +247,573 @@ func (s *Service) Start() error {
 	return nil
 }
 
-// Close closes the service.
-func (s *Service) Close() {
-	s.ln.Close()
+// Close closes the service. The listener is closed immediately, and in-flight
+// requests are given until shutdownTimeout to complete. Closing a service which
+// is already closed, or was never started, does nothing.
+func (s *Service) Close() error {
+	closed := false
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		closed = true
+	})
+	if !closed || s.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// Scheme returns the URL scheme of the service, "http" or "https".
+func (s *Service) Scheme() string {
+	if s.Certificate != nil {
+		return "https"
+	}
+	return "http"
 }
 
 // ServeHTTP allows Service to serve HTTP requests.
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if strings.HasPrefix(r.URL.Path, "/key") {
+	// Requests are authenticated before any forwarding, so the leader
+	// authenticates forwarded requests again.
+	if s.RootToken != "" {
+		acl, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="hraftd"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="hraftd"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !authorized(acl, r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		r = withACL(r, acl)
+	}
+
+	if requiresLeader(r) && !s.store.IsLeader() {
+		if s.Redirect {
+			s.redirect(w, r)
+		} else {
+			s.forward(w, r)
+		}
+		return
+	}
+
+	if r.URL.Path == "/keys" {
+		s.handleList(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/key") {
 		s.handleKeyRequest(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/watch/") {
+		s.handleWatch(w, r)
+	} else if r.URL.Path == "/txn" {
+		s.handleTxn(w, r)
 	} else if r.URL.Path == "/join" {
 		s.handleJoin(w, r)
+	} else if r.URL.Path == "/notify" {
+		s.handleNotify(w, r)
+	} else if r.URL.Path == "/remove" {
+		s.handleRemove(w, r)
+	} else if r.URL.Path == "/promote" {
+		s.handlePromote(w, r)
+	} else if r.URL.Path == "/leader/transfer" {
+		s.handleTransferLeadership(w, r)
 	} else if r.URL.Path == "/status" {
 		s.handleStatus(w, r)
+	} else if r.URL.Path == "/stats" {
+		s.handleStats(w, r)
+	} else if r.URL.Path == "/tokens" || strings.HasPrefix(r.URL.Path, "/tokens/") {
+		s.handleTokens(w, r)
+	} else if r.URL.Path == "/users" || strings.HasPrefix(r.URL.Path, "/users/") {
+		s.handleUsers(w, r)
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
+// requiresLeader returns whether the request can only be served by the
+// leader: writes, reads at a consistency level above none, joins, and changes
+// to tokens and users.
+func requiresLeader(r *http.Request) bool {
+	switch {
+	case r.URL.Path == "/keys":
+		return false
+	case strings.HasPrefix(r.URL.Path, "/key"):
+		if r.Method == "GET" {
+			l := r.URL.Query().Get("level")
+			return l == "weak" || l == "strong"
+		}
+		return r.Method == "POST" || r.Method == "DELETE"
+	case r.URL.Path == "/txn", r.URL.Path == "/join", r.URL.Path == "/promote", r.URL.Path == "/leader/transfer":
+		return r.Method == "POST"
+	case r.URL.Path == "/remove":
+		return r.Method == "DELETE"
+	case r.URL.Path == "/tokens", strings.HasPrefix(r.URL.Path, "/tokens/"),
+		r.URL.Path == "/users", strings.HasPrefix(r.URL.Path, "/users/"):
+		return r.Method == "POST" || r.Method == "DELETE"
+	default:
+		return false
+	}
+}
+
+// forward proxies the request to the HTTP API of the leader.
+func (s *Service) forward(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(forwardedHeader) != "" {
+		http.Error(w, store.ErrNotLeader.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	leader := s.store.LeaderHTTPAddr()
+	if leader == "" {
+		http.Error(w, "leader unknown", http.StatusServiceUnavailable)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport: s.proxyTransport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = s.Scheme()
+			pr.Out.URL.Host = leader
+			pr.Out.Host = leader
+			pr.SetXForwarded()
+			pr.Out.Header.Set(forwardedHeader, s.Addr().String())
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// redirect redirects the client to the HTTP API of the leader. A temporary
+// redirect is used, so the client repeats the request with the same method
+// and body.
+func (s *Service) redirect(w http.ResponseWriter, r *http.Request) {
+	leader := s.store.LeaderHTTPAddr()
+	if leader == "" {
+		http.Error(w, "leader unknown", http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(w, r, s.Scheme()+"://"+leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// joinRequest is the body of a join request. HTTPAddr is the address of the
+// joining node's HTTP API, and is optional. The node joins as a voter unless
+// Voter is set to false.
+type joinRequest struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	HTTPAddr string `json:"http_addr,omitempty"`
+	Voter    *bool  `json:"voter,omitempty"`
+}
+
 func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
-	m := map[string]string{}
-	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+	var req joinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if req.ID == "" || req.Addr == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if len(m) != 2 {
+	voter := req.Voter == nil || *req.Voter
+	if err := s.store.Join(req.ID, req.Addr, voter); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if req.HTTPAddr != "" {
+		if err := s.store.SetNodeHTTPAddr(req.ID, req.HTTPAddr); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// listResponse is the response to a request to list keys. If there are more
+// keys to list, Cursor is set, and should be passed as the cursor of the next
+// request.
+type listResponse struct {
+	Keys   []store.KeyValue `json:"keys"`
+	Cursor string           `json:"cursor,omitempty"`
+}
+
+func (s *Service) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > maxListLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	start := q.Get("start")
+	if c := q.Get("cursor"); c != "" {
+		start = c
+	}
+
+	// Fetch one key more than the limit, to find where the next page starts.
+	kvs, err := s.store.List(q.Get("prefix"), start, q.Get("end"), limit+1)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := listResponse{Keys: kvs}
+	if len(kvs) > limit {
+		resp.Keys = kvs[:limit]
+		resp.Cursor = kvs[limit].Key
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *Service) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/watch/")
+	q := r.URL.Query()
+	prefix := q.Get("prefix") == "true"
+	if key == "" && !prefix {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	remoteAddr, ok := m["addr"]
+	var index uint64
+	if i := q.Get("index"); i != "" {
+		n, err := strconv.ParseUint(i, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		index = n
+	}
+
+	// A reconnecting Server-Sent Events client resumes after the last event
+	// it received.
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if id := r.Header.Get("Last-Event-ID"); sse && id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		index = n + 1
+	}
+
+	wait := defaultWatchWait
+	if d := q.Get("wait"); d != "" {
+		dur, err := time.ParseDuration(d)
+		if err != nil || dur <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wait = dur
+	}
+
+	watcher, err := s.store.Watch(key, prefix, index)
+	if errors.Is(err, store.ErrCompacted) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer watcher.Close()
+
+	if sse {
+		streamEvents(w, r, watcher, s.closing)
+	} else {
+		pollEvents(w, r, watcher, wait, s.closing)
+	}
+}
+
+// pollEvents waits up to wait for at least one event, and then writes all
+// events received so far as a JSON array. The array is empty if no event was
+// received in time, or if closing is closed first.
+func pollEvents(w http.ResponseWriter, r *http.Request, watcher store.Watcher, wait time.Duration, closing <-chan struct{}) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	events := []store.Event{}
+	select {
+	case ev, ok := <-watcher.Events():
+		if ok {
+			events = append(events, ev)
+		}
+	case <-timer.C:
+	case <-closing:
+	case <-r.Context().Done():
+		return
+	}
+
+	// Collect any further events which are already available. These include
+	// the rest of the events of the same log entry, since they are delivered
+	// together, so the client can resume from the index after the last one.
+	for done := false; !done; {
+		select {
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				done = true
+				break
+			}
+			events = append(events, ev)
+		default:
+			done = true
+		}
+	}
+
+	b, err := json.Marshal(events)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// streamEvents writes events as Server-Sent Events until the client goes
+// away, the watcher is closed, or closing is closed. Only the last event of
+// each log entry carries an ID, so a client which reconnects with the
+// Last-Event-ID it received resumes after a whole log entry, never part way
+// through one.
+func streamEvents(w http.ResponseWriter, r *http.Request, watcher store.Watcher, closing <-chan struct{}) {
+	flusher, ok := w.(http.Flusher)
 	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				return
+			}
+			// The rest of the events of the log entry are available now.
+			events := []store.Event{ev}
+			for more := true; more; {
+				select {
+				case ev, ok := <-watcher.Events():
+					if ok {
+						events = append(events, ev)
+					}
+					more = ok
+				default:
+					more = false
+				}
+			}
+			for i, ev := range events {
+				b, err := json.Marshal(ev)
+				if err != nil {
+					return
+				}
+				if i == len(events)-1 || events[i+1].Index != ev.Index {
+					_, err = fmt.Fprintf(w, "id: %d\n", ev.Index)
+				}
+				if err == nil {
+					_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+				}
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		case <-closing:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// txnRequest is the body of a transaction request.
+type txnRequest struct {
+	Compare []store.Compare `json:"compare"`
+	Ops     []store.Op      `json:"ops"`
+}
+
+func (s *Service) handleTxn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req txnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	acl := requestACL(r)
+	for _, op := range req.Ops {
+		if (op.Op != "set" && op.Op != "delete") || op.Key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !acl.CanWrite(op.Key) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	for _, c := range req.Compare {
+		if c.Value == nil && c.Version == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !acl.CanRead(c.Key) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	result, err := s.store.Txn(req.Compare, req.Ops)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Succeeded {
+		w.WriteHeader(http.StatusConflict)
+	}
+	w.Write(b)
+}
+
+func (s *Service) handleNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if m["id"] == "" || m["addr"] == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	err := s.store.Notify(m["id"], m["addr"], m["http_addr"])
+	if errors.Is(err, store.ErrBootstrapDisabled) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, store.ErrTooManyPeers) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Service) handleRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	nodeID, ok := m["id"]
-	if !ok {
+	if !ok || nodeID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := s.store.Remove(nodeID)
+	if errors.Is(err, store.ErrNodeNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Service) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	nodeID, ok := m["id"]
+	if !ok || nodeID == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if err := s.store.Join(nodeID, remoteAddr); err != nil {
+	err := s.store.Promote(nodeID)
+	if errors.Is(err, store.ErrNodeNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
+func (s *Service) handleTransferLeadership(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The body, and so the target node, is optional.
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := s.store.TransferLeadership(m["id"])
+	if errors.Is(err, store.ErrNodeNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -147,6 +842,21 @@ func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Service) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.Marshal(s.store.Stats())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
 func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 	getKey := func() string {
 		parts := strings.Split(r.URL.Path, "/")
@@ -161,14 +871,27 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 		k := getKey()
 		if k == "" {
 			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-		v, err := s.store.Get(k)
+		level := store.ConsistencyNone
+		if l := r.URL.Query().Get("level"); l != "" {
+			var err error
+			if level, err = store.ParseConsistencyLevel(l); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		kv, ok, err := s.store.GetWithLevel(k, level)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if ok {
+			setMetadataHeaders(w, kv)
+		}
 
-		b, err := json.Marshal(map[string]string{k: v})
+		b, err := json.Marshal(map[string]string{k: kv.Value})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -176,18 +899,30 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, string(b))
 
 	case "POST":
+		// A POST to a specific key may be a conditional write, or
+		// carry a TTL.
+		if k := getKey(); k != "" {
+			s.handleSetKey(w, r, k)
+			return
+		}
+
 		// Read the value from the POST body.
 		m := map[string]string{}
 		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		for k, v := range m {
-			if err := s.store.Set(k, v); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+		acl := requestACL(r)
+		for k := range m {
+			if !acl.CanWrite(k) {
+				w.WriteHeader(http.StatusForbidden)
 				return
 			}
 		}
+		if err := s.store.SetMulti(m); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
 	case "DELETE":
 		k := getKey()
@@ -205,6 +940,66 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// setKeyRequest is the body of a write to a single key. At most one of
+// PrevValue and PrevVersion may be set. If neither is set, the write is
+// unconditional. TTL is in seconds, and may only be set on unconditional
+// writes.
+type setKeyRequest struct {
+	Value       string  `json:"value"`
+	PrevValue   *string `json:"prevValue,omitempty"`
+	PrevVersion *uint64 `json:"prevVersion,omitempty"`
+	TTL         int64   `json:"ttl,omitempty"`
+}
+
+func (s *Service) handleSetKey(w http.ResponseWriter, r *http.Request, key string) {
+	// Unknown fields are rejected, so a body meant for /key, such as
+	// {"foo":"bar"}, is not taken as an empty value.
+	var req setKeyRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch {
+	case req.PrevValue != nil && req.PrevVersion != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case req.TTL < 0 || (req.TTL > 0 && (req.PrevValue != nil || req.PrevVersion != nil)):
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case req.PrevValue != nil:
+		err = s.store.CompareAndSwap(key, *req.PrevValue, req.Value)
+	case req.PrevVersion != nil:
+		err = s.store.CompareAndSwapVersion(key, *req.PrevVersion, req.Value)
+	case req.TTL > 0:
+		err = s.store.SetWithTTL(key, req.Value, time.Duration(req.TTL)*time.Second)
+	default:
+		err = s.store.Set(key, req.Value)
+	}
+	if errors.Is(err, store.ErrConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// setMetadataHeaders sets the response headers carrying the revision metadata
+// and expiration of a key.
+func setMetadataHeaders(w http.ResponseWriter, kv store.KeyValue) {
+	w.Header().Set("X-Hraftd-Create-Index", strconv.FormatUint(kv.CreateIndex, 10))
+	w.Header().Set("X-Hraftd-Modify-Index", strconv.FormatUint(kv.ModifyIndex, 10))
+	w.Header().Set("X-Hraftd-Version", strconv.FormatUint(kv.Version, 10))
+	if !kv.Expiration.IsZero() {
+		w.Header().Set("X-Hraftd-Expiration", kv.Expiration.Format(time.RFC3339Nano))
+	}
+}
+
 // Addr returns the address on which the Service is listening
 func (s *Service) Addr() net.Addr {
 	return s.ln.Addr()
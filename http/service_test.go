@@ -1,16 +1,21 @@
 package httpd
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/otoolep/hraftd/internal/tlstest"
 	store "github.com/otoolep/hraftd/store"
+	"github.com/otoolep/hraftd/tlsutil"
 )
 
 // Test_NewServer tests that a server can perform all basic operations.
@@ -49,22 +54,981 @@ func Test_NewServer(t *testing.T) {
 	doStatus(t, s.URL())
 }
 
+// Test_Stats tests that the Raft statistics of the node are served.
+func Test_Stats(t *testing.T) {
+	s := &testServer{New(":0", newTestStore())}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/stats", s.URL()))
+	if err != nil {
+		t.Fatalf("failed to fetch stats: %s", err)
+	}
+	var stats store.ServerStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil || stats.LastIndex != 7 {
+		t.Fatalf("wrong stats received: %+v, %v", stats, err)
+	}
+}
+
+// Test_SetMulti tests that multiple keys can be set in a single POST.
+func Test_SetMulti(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	resp, err := http.Post(fmt.Sprintf("%s/key", s.URL()), "application-type/json", strings.NewReader(`{"k1":"v1","k2":"v2"}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code for POST: %d", resp.StatusCode)
+	}
+	if store.m["k1"] != "v1" || store.m["k2"] != "v2" {
+		t.Fatalf("keys not set by POST: %v", store.m)
+	}
+}
+
+// Test_CompareAndSwap tests that conditional writes are applied only when the
+// precondition is met.
+func Test_CompareAndSwap(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	store.m["k1"] = "v1"
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v2","prevValue":"v0"}`); code != http.StatusConflict {
+		t.Fatalf("wrong status code for failed CAS: %d", code)
+	}
+	if store.m["k1"] != "v1" {
+		t.Fatalf("key k1 changed by failed CAS: %s", store.m["k1"])
+	}
+
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v2","prevValue":"v1"}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for CAS: %d", code)
+	}
+	if store.m["k1"] != "v2" {
+		t.Fatalf("key k1 not changed by CAS: %s", store.m["k1"])
+	}
+
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v3"}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for unconditional write: %d", code)
+	}
+	if store.m["k1"] != "v3" {
+		t.Fatalf("key k1 not changed by unconditional write: %s", store.m["k1"])
+	}
+}
+
+// Test_CompareAndSwapVersion tests that revision metadata is returned, and that
+// conditional writes on a version are applied only when the version matches.
+func Test_CompareAndSwapVersion(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v1","prevVersion":0}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for CAS on non-existent key: %d", code)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/key/k1", s.URL()))
+	if err != nil {
+		t.Fatalf("failed to GET key: %s", err)
+	}
+	resp.Body.Close()
+	if v := resp.Header.Get("X-Hraftd-Version"); v != "1" {
+		t.Fatalf("wrong version received for key k1: %s", v)
+	}
+
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v2","prevVersion":0}`); code != http.StatusConflict {
+		t.Fatalf("wrong status code for failed CAS: %d", code)
+	}
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v2","prevVersion":1}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for CAS: %d", code)
+	}
+	if store.m["k1"] != "v2" {
+		t.Fatalf("key k1 not changed by CAS: %s", store.m["k1"])
+	}
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v3","prevValue":"v2","prevVersion":2}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for CAS with two preconditions: %d", code)
+	}
+	if code := doCAS(t, s.URL(), "foo", `{"foo":"bar"}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for write with unknown field: %d", code)
+	}
+	if _, ok := store.m["foo"]; ok {
+		t.Fatalf("key foo set by write with unknown field")
+	}
+}
+
+// Test_SetWithTTL tests that a TTL can be set on a key.
+func Test_SetWithTTL(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v1","ttl":30}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for write with TTL: %d", code)
+	}
+	if store.m["k1"] != "v1" {
+		t.Fatalf("key k1 not set: %s", store.m["k1"])
+	}
+	if store.ttls["k1"] != 30*time.Second {
+		t.Fatalf("key k1 has wrong TTL: %s", store.ttls["k1"])
+	}
+
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v2","ttl":30,"prevVersion":1}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for conditional write with TTL: %d", code)
+	}
+	if code := doCAS(t, s.URL(), "k1", `{"value":"v2","ttl":-1}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for write with negative TTL: %d", code)
+	}
+}
+
+// Test_Txn tests that transactions are applied only when all compares hold,
+// and that per-op results are returned.
+func Test_Txn(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	store.m["k1"] = "v1"
+	store.m["k2"] = "v2"
+
+	body := `{"compare":[{"key":"k1","value":"v0"}],"ops":[{"op":"set","key":"k3","value":"v3"}]}`
+	code, b := doTxn(t, s.URL(), body)
+	if code != http.StatusConflict {
+		t.Fatalf("wrong status code for failed transaction: %d", code)
+	}
+	if b != `{"succeeded":false,"results":[]}` {
+		t.Fatalf("wrong result for failed transaction: %s", b)
+	}
+	if _, ok := store.m["k3"]; ok {
+		t.Fatalf("key k3 set by failed transaction")
+	}
+
+	body = `{"compare":[{"key":"k1","value":"v1"},{"key":"k3","version":0}],"ops":[{"op":"set","key":"k3","value":"v3"},{"op":"delete","key":"k2"}]}`
+	code, b = doTxn(t, s.URL(), body)
+	if code != http.StatusOK {
+		t.Fatalf("wrong status code for transaction: %d", code)
+	}
+	if b != `{"succeeded":true,"results":[{"op":"set","key":"k3","version":1},{"op":"delete","key":"k2","deleted":true}]}` {
+		t.Fatalf("wrong result for transaction: %s", b)
+	}
+	if store.m["k3"] != "v3" {
+		t.Fatalf("key k3 not set by transaction")
+	}
+	if _, ok := store.m["k2"]; ok {
+		t.Fatalf("key k2 not deleted by transaction")
+	}
+
+	code, _ = doTxn(t, s.URL(), `{"ops":[{"op":"get","key":"k1"}]}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for transaction with bad op: %d", code)
+	}
+	code, _ = doTxn(t, s.URL(), `{"compare":[{"key":"k1","vale":"v1"}],"ops":[{"op":"delete","key":"k1"}]}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for transaction with empty compare: %d", code)
+	}
+	if _, ok := store.m["k1"]; !ok {
+		t.Fatalf("key k1 deleted by transaction with empty compare")
+	}
+}
+
+// Test_List tests that keys can be listed by prefix, with pagination.
+func Test_List(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	for _, k := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		store.Set(k, "v")
+	}
+
+	var keys []string
+	cursor := ""
+	pages := 0
+	for {
+		resp, err := http.Get(fmt.Sprintf("%s/keys?prefix=a/&limit=2&cursor=%s", s.URL(), url.QueryEscape(cursor)))
+		if err != nil {
+			t.Fatalf("failed to list keys: %s", err)
+		}
+		var lr listResponse
+		err = json.NewDecoder(resp.Body).Decode(&lr)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode list response: %s", err)
+		}
+		for _, kv := range lr.Keys {
+			keys = append(keys, kv.Key)
+		}
+		pages++
+		if lr.Cursor == "" {
+			break
+		}
+		cursor = lr.Cursor
+	}
+	if strings.Join(keys, ",") != "a/1,a/2,a/3" || pages != 2 {
+		t.Fatalf("wrong keys listed: %v in %d pages", keys, pages)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/keys?limit=0", s.URL()))
+	if err != nil {
+		t.Fatalf("failed to list keys: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("wrong status code for bad limit: %d", resp.StatusCode)
+	}
+}
+
+// Test_Watch tests that events can be received by long-polling, and as
+// Server-Sent Events.
+func Test_Watch(t *testing.T) {
+	ts := newTestStore()
+	s := &testServer{New(":0", ts)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	ts.events = []store.Event{
+		{Type: "set", Index: 5, KV: store.KeyValue{Key: "a/1", Value: "v1"}},
+		{Type: "set", Index: 6, KV: store.KeyValue{Key: "b/1", Value: "v2"}},
+		{Type: "delete", Index: 7, KV: store.KeyValue{Key: "a/2"}},
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/watch/a/?prefix=true&index=5", s.URL()))
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	var events []store.Event
+	err = json.NewDecoder(resp.Body).Decode(&events)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode events: %s", err)
+	}
+	if len(events) != 2 || events[0].Index != 5 || events[1].Type != "delete" {
+		t.Fatalf("wrong events received: %+v", events)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/watch/a/?prefix=true", s.URL()), nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "5")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("wrong content type for event stream: %s", ct)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 4 || lines[0] != "id: 7" || lines[1] != "event: delete" {
+		t.Fatalf("wrong event stream received: %q", lines)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("%s/watch/a/1?index=1", s.URL()))
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("wrong status code for compacted index: %d", resp.StatusCode)
+	}
+}
+
+// Test_Close tests that closing the service ends in-flight watches, and stops
+// new requests being served.
+func Test_Close(t *testing.T) {
+	ts := newTestStore()
+	s := &testServer{New(":0", ts)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	done := make(chan string)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("%s/watch/foo?wait=1m", s.URL()))
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		done <- string(b)
+	}()
+
+	// Give the watch time to start.
+	time.Sleep(500 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close HTTP service: %s", err)
+	}
+	select {
+	case body := <-done:
+		if body != "[]" {
+			t.Fatalf("wrong response to watch during close: %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watch not ended by close")
+	}
+
+	if _, err := http.Get(fmt.Sprintf("%s/status", s.URL())); err == nil {
+		t.Fatalf("request served after close")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close HTTP service a second time: %s", err)
+	}
+
+	if err := New(":0", ts).Close(); err != nil {
+		t.Fatalf("failed to close HTTP service which was never started: %s", err)
+	}
+}
+
+// Test_ReadConsistency tests that the read consistency level can be selected.
+func Test_ReadConsistency(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	store.m["k1"] = "v1"
+	for _, tt := range []struct {
+		level     string
+		notLeader bool
+		code      int
+	}{
+		{"none", false, http.StatusOK},
+		{"weak", false, http.StatusOK},
+		{"strong", false, http.StatusOK},
+		{"none", true, http.StatusOK},
+		{"strong", true, http.StatusServiceUnavailable},
+		{"bogus", false, http.StatusBadRequest},
+	} {
+		store.notLeader = tt.notLeader
+		resp, err := http.Get(fmt.Sprintf("%s/key/k1?level=%s", s.URL(), tt.level))
+		if err != nil {
+			t.Fatalf("failed to GET key: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Fatalf("wrong status code for level %s (not leader: %v): %d", tt.level, tt.notLeader, resp.StatusCode)
+		}
+	}
+}
+
+// Test_Forwarding tests that requests requiring the leader are forwarded to it
+// by a follower.
+func Test_Forwarding(t *testing.T) {
+	leaderStore := newTestStore()
+	leader := &testServer{New(":0", leaderStore)}
+	if err := leader.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	followerStore := newTestStore()
+	followerStore.notLeader = true
+	follower := &testServer{New(":0", followerStore)}
+	if err := follower.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	// The leader is unknown.
+	resp, err := http.Post(fmt.Sprintf("%s/key", follower.URL()), "application-type/json", strings.NewReader(`{"k1":"v1"}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code with unknown leader: %d", resp.StatusCode)
+	}
+
+	followerStore.leaderAddr = strings.TrimPrefix(leader.URL(), "http://")
+	doPost(t, follower.URL(), "k1", "v1")
+	if leaderStore.m["k1"] != "v1" {
+		t.Fatalf("write not forwarded to leader")
+	}
+	if _, ok := followerStore.m["k1"]; ok {
+		t.Fatalf("write applied to follower")
+	}
+
+	b := doGet(t, follower.URL(), "k1?level=strong")
+	if b != `{"k1":"v1"}` {
+		t.Fatalf("strong read not forwarded to leader: %s", b)
+	}
+	b = doGet(t, follower.URL(), "k1")
+	if b != `{"k1":""}` {
+		t.Fatalf("read at level none forwarded to leader: %s", b)
+	}
+
+	resp, err = http.Post(fmt.Sprintf("%s/join", follower.URL()), "application-type/json",
+		strings.NewReader(`{"id":"n2","addr":"127.0.0.1:12002","http_addr":"127.0.0.1:11002"}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if leaderStore.nodes["n2"] != "127.0.0.1:11002" {
+		t.Fatalf("join not forwarded to leader")
+	}
+
+	// A forwarded request is not forwarded again.
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/key/k1", follower.URL()), nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("X-Hraftd-Forwarded", "127.0.0.1:1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code for forwarded request: %d", resp.StatusCode)
+	}
+}
+
+// Test_Redirect tests that requests requiring the leader are redirected to it
+// by a follower, if so configured.
+func Test_Redirect(t *testing.T) {
+	leaderStore := newTestStore()
+	leader := &testServer{New(":0", leaderStore)}
+	if err := leader.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	followerStore := newTestStore()
+	followerStore.notLeader = true
+	followerStore.leaderAddr = strings.TrimPrefix(leader.URL(), "http://")
+	follower := &testServer{New(":0", followerStore)}
+	follower.Redirect = true
+	if err := follower.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Post(fmt.Sprintf("%s/key/k1?x=y", follower.URL()), "application-type/json", strings.NewReader(`{"value":"v1"}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("wrong status code for redirect: %d", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != leader.URL()+"/key/k1?x=y" {
+		t.Fatalf("wrong redirect location: %s", loc)
+	}
+
+	// The default client follows the redirect, repeating the POST.
+	doCAS(t, follower.URL(), "k1", `{"value":"v1"}`)
+	if leaderStore.m["k1"] != "v1" {
+		t.Fatalf("redirected write not applied on leader")
+	}
+	if _, ok := followerStore.m["k1"]; ok {
+		t.Fatalf("write applied to follower")
+	}
+}
+
+// Test_TLS tests that the service can serve HTTPS, verifying client
+// certificates, and forward requests to the leader over HTTPS.
+func Test_TLS(t *testing.T) {
+	dir := t.TempDir()
+	files := tlstest.Write(t, dir)
+	cert, err := tlsutil.LoadCertificate(files.Cert, files.Key)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+	newTLSServer := func(ts *testStore) *testServer {
+		s := &testServer{New(":0", ts)}
+		s.Certificate = cert
+		s.CAFile = files.CA
+		s.VerifyClient = true
+		if err := s.Start(); err != nil {
+			t.Fatalf("failed to start HTTP service: %s", err)
+		}
+		return s
+	}
+	leaderStore := newTestStore()
+	leader := newTLSServer(leaderStore)
+	defer leader.Close()
+	followerStore := newTestStore()
+	followerStore.notLeader = true
+	followerStore.leaderAddr = strings.TrimPrefix(leader.URL(), "https://")
+	follower := newTLSServer(followerStore)
+	defer follower.Close()
+	if !strings.HasPrefix(follower.URL(), "https://") {
+		t.Fatalf("wrong URL for HTTPS service: %s", follower.URL())
+	}
+
+	tlsConfig, err := tlsutil.ClientConfig(cert, files.CA)
+	if err != nil {
+		t.Fatalf("failed to create client config: %s", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Post(fmt.Sprintf("%s/key", follower.URL()), "application-type/json", strings.NewReader(`{"k1":"v1"}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code for forwarded write: %d", resp.StatusCode)
+	}
+	if leaderStore.m["k1"] != "v1" {
+		t.Fatalf("forwarded write not applied on leader")
+	}
+
+	tlsConfig, err = tlsutil.ClientConfig(nil, files.CA)
+	if err != nil {
+		t.Fatalf("failed to create client config: %s", err)
+	}
+	noCertClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	if resp, err := noCertClient.Get(fmt.Sprintf("%s/key/k1", leader.URL())); err == nil {
+		resp.Body.Close()
+		t.Fatalf("request without client certificate served")
+	}
+	if resp, err := http.Get(fmt.Sprintf("http://%s/key/k1", leader.Addr())); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatalf("plaintext request served")
+		}
+	}
+
+	// Replace the certificate, and its CA. Clients which trust only the old
+	// CA can no longer connect, once the certificate is reloaded.
+	tlstest.Write(t, dir)
+	if err := cert.Reload(); err != nil {
+		t.Fatalf("failed to reload certificate: %s", err)
+	}
+	oldClient := &http.Client{Transport: &http.Transport{TLSClientConfig: client.Transport.(*http.Transport).TLSClientConfig}}
+	if resp, err := oldClient.Get(fmt.Sprintf("%s/key/k1", leader.URL())); err == nil {
+		resp.Body.Close()
+		t.Fatalf("reloaded certificate not served")
+	}
+}
+
+// Test_Remove tests that a node can be removed from the cluster.
+func Test_Remove(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	store.nodes["n1"] = "127.0.0.1:11001"
+	if code := doRemove(t, s.URL(), `{"id":"n1"}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for remove: %d", code)
+	}
+	if _, ok := store.nodes["n1"]; ok {
+		t.Fatalf("node not removed")
+	}
+	if code := doRemove(t, s.URL(), `{"id":"n1"}`); code != http.StatusNotFound {
+		t.Fatalf("wrong status code for removing unknown node: %d", code)
+	}
+	if code := doRemove(t, s.URL(), `{}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for remove without ID: %d", code)
+	}
+}
+
+// Test_Notify tests that a node waiting to bootstrap can be notified of its
+// peers.
+func Test_Notify(t *testing.T) {
+	ts := newTestStore()
+	s := &testServer{New(":0", ts)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	if code := doNotify(t, s.URL(), `{"id":"n1","addr":"127.0.0.1:12001"}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for notify with bootstrapping disabled: %d", code)
+	}
+
+	ts.peers = make(map[string][2]string)
+	if code := doNotify(t, s.URL(), `{"id":"n1","addr":"127.0.0.1:12001","http_addr":"127.0.0.1:11001"}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for notify: %d", code)
+	}
+	if ts.peers["n1"] != [2]string{"127.0.0.1:12001", "127.0.0.1:11001"} {
+		t.Fatalf("peer not notified: %v", ts.peers)
+	}
+	if code := doNotify(t, s.URL(), `{"id":"n2"}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for notify without address: %d", code)
+	}
+
+	// A notify never requires the leader, since there is none yet.
+	ts.notLeader = true
+	if code := doNotify(t, s.URL(), `{"id":"n2","addr":"127.0.0.1:12002"}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for notify on non-leader: %d", code)
+	}
+}
+
+// Test_Nonvoter tests that a node can join as a non-voter, and be promoted.
+func Test_Nonvoter(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	for _, body := range []string{
+		`{"id":"n1","addr":"127.0.0.1:12001"}`,
+		`{"id":"n2","addr":"127.0.0.1:12002","voter":false}`,
+	} {
+		resp, err := http.Post(fmt.Sprintf("%s/join", s.URL()), "application-type/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST request failed: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status code for join: %d", resp.StatusCode)
+		}
+	}
+	if !store.voters["n1"] || store.voters["n2"] {
+		t.Fatalf("nodes joined with wrong suffrage: %v", store.voters)
+	}
+
+	resp, err := http.Post(fmt.Sprintf("%s/promote", s.URL()), "application-type/json", strings.NewReader(`{"id":"n2"}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !store.voters["n2"] {
+		t.Fatalf("node not promoted, status code: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(fmt.Sprintf("%s/promote", s.URL()), "application-type/json", strings.NewReader(`{"id":"n3"}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("wrong status code for promoting unknown node: %d", resp.StatusCode)
+	}
+}
+
+// Test_TransferLeadership tests that leadership can be transferred, to any
+// node or to a given one.
+func Test_TransferLeadership(t *testing.T) {
+	store := newTestStore()
+	s := &testServer{New(":0", store)}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	store.voters["n1"] = true
+
+	for _, tt := range []struct {
+		body string
+		code int
+		to   string
+	}{
+		{"", http.StatusOK, ""},
+		{`{"id":"n1"}`, http.StatusOK, "n1"},
+		{`{"id":"n2"}`, http.StatusNotFound, ""},
+	} {
+		store.transferredTo = nil
+		resp, err := http.Post(fmt.Sprintf("%s/leader/transfer", s.URL()), "application-type/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("POST request failed: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Fatalf("wrong status code for transfer with body %q: %d", tt.body, resp.StatusCode)
+		}
+		if tt.code == http.StatusOK && (store.transferredTo == nil || *store.transferredTo != tt.to) {
+			t.Fatalf("leadership not transferred to %q", tt.to)
+		}
+	}
+}
+
 type testServer struct {
 	*Service
 }
 
+// Test_Auth tests that requests must carry a token, and are only served if the
+// token's ACL allows them.
+func Test_Auth(t *testing.T) {
+	ts := newTestStore()
+	s := &testServer{New(":0", ts)}
+	s.RootToken = "root"
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+	ts.m["app1"] = "v1"
+	ts.m["other"] = "v2"
+
+	resp, err := http.Get(fmt.Sprintf("%s/key/app1", s.URL()))
+	if err != nil {
+		t.Fatalf("GET request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("wrong response for request without token: %d", resp.StatusCode)
+	}
+	if code, _ := doAuth(t, "GET", s.URL()+"/key/app1", "wrong", ""); code != http.StatusUnauthorized {
+		t.Fatalf("wrong status code for invalid token: %d", code)
+	}
+
+	code, body := doAuth(t, "POST", s.URL()+"/tokens", "root", `{"name":"app","rules":[{"prefix":"app","read":true,"write":true},{"prefix":"","read":true}]}`)
+	if code != http.StatusCreated {
+		t.Fatalf("wrong status code for token creation: %d", code)
+	}
+	var created tokenResponse
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatalf("failed to decode token: %s", err)
+	}
+	if code, _ := doAuth(t, "POST", s.URL()+"/tokens", "root", `{"name":"app"}`); code != http.StatusConflict {
+		t.Fatalf("wrong status code for duplicate token: %d", code)
+	}
+	if code, _ := doAuth(t, "POST", s.URL()+"/tokens", created.Token, `{"name":"escalate","admin":true}`); code != http.StatusForbidden {
+		t.Fatalf("wrong status code for token creation without admin: %d", code)
+	}
+	if _, body := doAuth(t, "GET", s.URL()+"/tokens", "root", ""); body != `[{"name":"app","rules":[{"prefix":"app","read":true,"write":true},{"prefix":"","read":true}]}]` {
+		t.Fatalf("wrong tokens listed: %s", body)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"GET", "/key/other", "", http.StatusOK},
+		{"GET", "/key/", "", http.StatusForbidden},
+		{"GET", "/key/app1/x", "", http.StatusForbidden},
+		{"POST", "/key/", `{"app2":"v3"}`, http.StatusForbidden},
+		{"POST", "/key/app1", `{"value":"v3"}`, http.StatusOK},
+		{"POST", "/key/other", `{"value":"v3"}`, http.StatusForbidden},
+		{"DELETE", "/key/other", "", http.StatusForbidden},
+		{"POST", "/key", `{"app2":"v3"}`, http.StatusOK},
+		{"POST", "/key", `{"app3":"v3","other":"v3"}`, http.StatusForbidden},
+		{"POST", "/txn", `{"compare":[{"key":"other","value":"v2"}],"ops":[{"op":"set","key":"app1","value":"v4"}]}`, http.StatusOK},
+		{"POST", "/txn", `{"ops":[{"op":"delete","key":"other"}]}`, http.StatusForbidden},
+		{"GET", "/status", "", http.StatusOK},
+		{"POST", "/join", `{"id":"n1","addr":"127.0.0.1:0"}`, http.StatusForbidden},
+		{"DELETE", "/tokens/app", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if code, _ := doAuth(t, tt.method, s.URL()+tt.path, created.Token, tt.body); code != tt.code {
+			t.Fatalf("wrong status code for %s %s: %d, expected %d", tt.method, tt.path, code, tt.code)
+		}
+	}
+	if ts.m["other"] != "v2" || ts.m["app1"] != "v4" || ts.m["app3"] != "" {
+		t.Fatalf("writes not applied as permitted: %v", ts.m)
+	}
+
+	// A read of a malformed key path is rejected, without reading any key.
+	ts.m[""] = "secret"
+	if code, body := doAuth(t, "GET", s.URL()+"/key/", "root", ""); code != http.StatusBadRequest || body != "" {
+		t.Fatalf("wrong response for read without key: %d %s", code, body)
+	}
+
+	if code, _ := doAuth(t, "DELETE", s.URL()+"/tokens/app", "root", ""); code != http.StatusOK {
+		t.Fatalf("wrong status code for token deletion: %d", code)
+	}
+	if code, _ := doAuth(t, "DELETE", s.URL()+"/tokens/app", "root", ""); code != http.StatusNotFound {
+		t.Fatalf("wrong status code for deleting missing token: %d", code)
+	}
+	if code, _ := doAuth(t, "GET", s.URL()+"/key/app1", created.Token, ""); code != http.StatusUnauthorized {
+		t.Fatalf("wrong status code for deleted token: %d", code)
+	}
+}
+
+// Test_Users tests that users can be managed by an admin, and authenticate
+// with their password.
+func Test_Users(t *testing.T) {
+	ts := newTestStore()
+	s := &testServer{New(":0", ts)}
+	s.RootToken = "root"
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	doBasic := func(method, path, user, password, body string) int {
+		req, err := http.NewRequest(method, s.URL()+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		req.SetBasicAuth(user, password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %s", method, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code, _ := doAuth(t, "POST", s.URL()+"/users", "root", `{"name":"alice","password":"pw","roles":["superuser"]}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for invalid role: %d", code)
+	}
+	if code, _ := doAuth(t, "POST", s.URL()+"/users", "root", `{"name":"alice","roles":["reader"]}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code for missing password: %d", code)
+	}
+	if code, _ := doAuth(t, "POST", s.URL()+"/users", "root", `{"name":"alice","password":"pw","roles":["reader"]}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for setting user: %d", code)
+	}
+	if _, body := doAuth(t, "GET", s.URL()+"/users", "root", ""); body != `[{"name":"alice","roles":["reader"]}]` {
+		t.Fatalf("wrong users listed: %s", body)
+	}
+
+	if code := doBasic("GET", "/key/k1", "alice", "pw", ""); code != http.StatusOK {
+		t.Fatalf("wrong status code for read by reader: %d", code)
+	}
+	if code := doBasic("GET", "/key/k1", "alice", "wrong", ""); code != http.StatusUnauthorized {
+		t.Fatalf("wrong status code for wrong password: %d", code)
+	}
+	if code := doBasic("POST", "/key/k1", "alice", "pw", `{"value":"v1"}`); code != http.StatusForbidden {
+		t.Fatalf("wrong status code for write by reader: %d", code)
+	}
+	if code := doBasic("POST", "/users", "alice", "pw", `{"name":"alice","password":"pw","roles":["admin"]}`); code != http.StatusForbidden {
+		t.Fatalf("wrong status code for setting user without admin: %d", code)
+	}
+
+	// Changing the password and roles takes effect immediately.
+	if code, _ := doAuth(t, "POST", s.URL()+"/users", "root", `{"name":"alice","password":"pw2","roles":["writer"]}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for updating user: %d", code)
+	}
+	if code := doBasic("POST", "/key/k1", "alice", "pw", `{"value":"v1"}`); code != http.StatusUnauthorized {
+		t.Fatalf("wrong status code for old password: %d", code)
+	}
+	if code := doBasic("POST", "/key/k1", "alice", "pw2", `{"value":"v1"}`); code != http.StatusOK {
+		t.Fatalf("wrong status code for write by writer: %d", code)
+	}
+
+	if code, _ := doAuth(t, "DELETE", s.URL()+"/users/alice", "root", ""); code != http.StatusOK {
+		t.Fatalf("wrong status code for deleting user: %d", code)
+	}
+	if code, _ := doAuth(t, "DELETE", s.URL()+"/users/alice", "root", ""); code != http.StatusNotFound {
+		t.Fatalf("wrong status code for deleting missing user: %d", code)
+	}
+	if code := doBasic("GET", "/key/k1", "alice", "pw2", ""); code != http.StatusUnauthorized {
+		t.Fatalf("wrong status code for deleted user: %d", code)
+	}
+}
+
+// Test_WatchLogEntry tests that only the last Server-Sent Event of each log
+// entry carries an ID, so a client never resumes part way through an entry.
+func Test_WatchLogEntry(t *testing.T) {
+	ts := newTestStore()
+	s := &testServer{New(":0", ts)}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	ts.events = []store.Event{
+		{Type: "set", Index: 7, KV: store.KeyValue{Key: "a/1", Value: "v1"}},
+		{Type: "set", Index: 8, KV: store.KeyValue{Key: "a/2", Value: "v2"}},
+		{Type: "delete", Index: 8, KV: store.KeyValue{Key: "a/3"}},
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/watch/a/?prefix=true&index=7", s.URL()), nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer resp.Body.Close()
+	var ids []string
+	scanner := bufio.NewScanner(resp.Body)
+	events := 0
+	for scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			ids = append(ids, id)
+		}
+		if strings.HasPrefix(scanner.Text(), "event: ") {
+			events++
+		}
+	}
+	if events != 3 || strings.Join(ids, ",") != "7,8" {
+		t.Fatalf("wrong event IDs received: %d events, IDs %v", events, ids)
+	}
+}
+
 func (t *testServer) URL() string {
 	port := strings.TrimLeft(t.Addr().String(), "[::]:")
-	return fmt.Sprintf("http://127.0.0.1:%s", port)
+	return fmt.Sprintf("%s://127.0.0.1:%s", t.Scheme(), port)
 }
 
 type testStore struct {
-	m map[string]string
+	m        map[string]string
+	versions map[string]uint64
+	ttls     map[string]time.Duration
+
+	// notLeader causes reads requiring leadership to fail, and requests
+	// requiring leadership to be forwarded to leaderAddr.
+	notLeader  bool
+	leaderAddr string
+	nodes      map[string]string
+	voters     map[string]bool
+
+	transferredTo *string
+
+	// peers are the Raft and HTTP addresses of the nodes notified while
+	// waiting to bootstrap. If nil, bootstrapping is disabled.
+	peers map[string][2]string
+
+	// events are delivered to every watcher, after which the watcher is
+	// closed.
+	events []store.Event
+
+	// tokens are keyed by secret.
+	tokens map[string]store.Token
+
+	// users are keyed by name, and passwords by user name.
+	users     map[string]store.User
+	passwords map[string]string
 }
 
 func newTestStore() *testStore {
 	return &testStore{
-		m: make(map[string]string),
+		m:         make(map[string]string),
+		versions:  make(map[string]uint64),
+		ttls:      make(map[string]time.Duration),
+		nodes:     make(map[string]string),
+		voters:    make(map[string]bool),
+		tokens:    make(map[string]store.Token),
+		users:     make(map[string]store.User),
+		passwords: make(map[string]string),
 	}
 }
 
@@ -72,20 +1036,177 @@ func (t *testStore) Get(key string) (string, error) {
 	return t.m[key], nil
 }
 
+func (t *testStore) GetKeyValue(key string) (store.KeyValue, bool, error) {
+	v, ok := t.m[key]
+	return store.KeyValue{Key: key, Value: v, Version: t.versions[key]}, ok, nil
+}
+
+func (t *testStore) GetWithLevel(key string, level store.ConsistencyLevel) (store.KeyValue, bool, error) {
+	if level != store.ConsistencyNone && t.notLeader {
+		return store.KeyValue{}, false, store.ErrNotLeader
+	}
+	return t.GetKeyValue(key)
+}
+
+func (t *testStore) List(prefix, start, end string, limit int) ([]store.KeyValue, error) {
+	keys := []string{}
+	for k := range t.m {
+		if strings.HasPrefix(k, prefix) && k >= start && (end == "" || k < end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	kvs := make([]store.KeyValue, len(keys))
+	for i, k := range keys {
+		kvs[i] = store.KeyValue{Key: k, Value: t.m[k], Version: t.versions[k]}
+	}
+	return kvs, nil
+}
+
 func (t *testStore) Set(key, value string) error {
 	t.m[key] = value
+	t.versions[key]++
+	return nil
+}
+
+func (t *testStore) SetMulti(m map[string]string) error {
+	for k, v := range m {
+		t.Set(k, v)
+	}
 	return nil
 }
 
+func (t *testStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	t.ttls[key] = ttl
+	return t.Set(key, value)
+}
+
+func (t *testStore) CompareAndSwap(key, prevValue, value string) error {
+	if t.m[key] != prevValue {
+		return store.ErrConflict
+	}
+	return t.Set(key, value)
+}
+
+func (t *testStore) CompareAndSwapVersion(key string, prevVersion uint64, value string) error {
+	if t.versions[key] != prevVersion {
+		return store.ErrConflict
+	}
+	return t.Set(key, value)
+}
+
 func (t *testStore) Delete(key string) error {
 	delete(t.m, key)
+	delete(t.versions, key)
+	return nil
+}
+
+func (t *testStore) Txn(compares []store.Compare, ops []store.Op) (store.TxnResult, error) {
+	for _, c := range compares {
+		if c.Value != nil && t.m[c.Key] != *c.Value {
+			return store.TxnResult{Results: []store.OpResult{}}, nil
+		}
+		if c.Version != nil && t.versions[c.Key] != *c.Version {
+			return store.TxnResult{Results: []store.OpResult{}}, nil
+		}
+	}
+	results := make([]store.OpResult, len(ops))
+	for i, op := range ops {
+		results[i] = store.OpResult{Op: op.Op, Key: op.Key}
+		if op.Op == "set" {
+			t.Set(op.Key, op.Value)
+			results[i].Version = t.versions[op.Key]
+		} else {
+			_, results[i].Deleted = t.m[op.Key]
+			t.Delete(op.Key)
+		}
+	}
+	return store.TxnResult{Succeeded: true, Results: results}, nil
+}
+
+func (t *testStore) Watch(key string, prefix bool, index uint64) (store.Watcher, error) {
+	if index == 1 {
+		return nil, store.ErrCompacted
+	}
+	ch := make(chan store.Event, len(t.events))
+	for _, ev := range t.events {
+		if ev.Index >= index && (ev.KV.Key == key || (prefix && strings.HasPrefix(ev.KV.Key, key))) {
+			ch <- ev
+		}
+	}
+	close(ch)
+	return &testWatcher{ch: ch}, nil
+}
+
+type testWatcher struct {
+	ch chan store.Event
+}
+
+func (t *testWatcher) Events() <-chan store.Event {
+	return t.ch
+}
+
+func (t *testWatcher) Close() {}
+
+func (t *testStore) Join(nodeID, addr string, voter bool) error {
+	t.voters[nodeID] = voter
+	return nil
+}
+
+func (t *testStore) Notify(nodeID, addr, httpAddr string) error {
+	if t.peers == nil {
+		return store.ErrBootstrapDisabled
+	}
+	t.peers[nodeID] = [2]string{addr, httpAddr}
+	return nil
+}
+
+func (t *testStore) TransferLeadership(nodeID string) error {
+	if nodeID != "" {
+		if _, ok := t.voters[nodeID]; !ok {
+			return store.ErrNodeNotFound
+		}
+	}
+	t.transferredTo = &nodeID
 	return nil
 }
 
-func (t *testStore) Join(nodeID, addr string) error {
+func (t *testStore) Promote(nodeID string) error {
+	if _, ok := t.voters[nodeID]; !ok {
+		return store.ErrNodeNotFound
+	}
+	t.voters[nodeID] = true
 	return nil
 }
 
+func (t *testStore) Remove(nodeID string) error {
+	if _, ok := t.nodes[nodeID]; !ok {
+		return store.ErrNodeNotFound
+	}
+	delete(t.nodes, nodeID)
+	return nil
+}
+
+func (t *testStore) SetNodeHTTPAddr(nodeID, httpAddr string) error {
+	t.nodes[nodeID] = httpAddr
+	return nil
+}
+
+func (t *testStore) IsLeader() bool {
+	return !t.notLeader
+}
+
+func (t *testStore) LeaderHTTPAddr() string {
+	return t.leaderAddr
+}
+
+func (t *testStore) Stats() store.ServerStats {
+	return store.ServerStats{LastIndex: 7, AppliedIndex: 7}
+}
+
 func (t *testStore) Status() (store.StoreStatus, error) {
 	return store.StoreStatus{
 		Me: store.Node{
@@ -100,6 +1221,78 @@ func (t *testStore) Status() (store.StoreStatus, error) {
 	}, nil
 }
 
+func (t *testStore) CreateToken(name string, acl store.ACL) (string, error) {
+	for _, tok := range t.tokens {
+		if tok.Name == name {
+			return "", store.ErrTokenExists
+		}
+	}
+	secret := "secret-" + name
+	t.tokens[secret] = store.Token{Name: name, ACL: acl}
+	return secret, nil
+}
+
+func (t *testStore) DeleteToken(name string) error {
+	for secret, tok := range t.tokens {
+		if tok.Name == name {
+			delete(t.tokens, secret)
+			return nil
+		}
+	}
+	return store.ErrTokenNotFound
+}
+
+func (t *testStore) Tokens() []store.Token {
+	tokens := []store.Token{}
+	for _, tok := range t.tokens {
+		tokens = append(tokens, tok)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens
+}
+
+func (t *testStore) AuthenticateToken(secret string) (store.ACL, bool) {
+	tok, ok := t.tokens[secret]
+	return tok.ACL, ok
+}
+
+func (t *testStore) SetUser(name, password string, roles []string) error {
+	for _, role := range roles {
+		if role != store.RoleAdmin && role != store.RoleWriter && role != store.RoleReader {
+			return store.ErrInvalidRole
+		}
+	}
+	t.users[name] = store.User{Name: name, Roles: roles}
+	t.passwords[name] = password
+	return nil
+}
+
+func (t *testStore) DeleteUser(name string) error {
+	if _, ok := t.users[name]; !ok {
+		return store.ErrUserNotFound
+	}
+	delete(t.users, name)
+	delete(t.passwords, name)
+	return nil
+}
+
+func (t *testStore) Users() []store.User {
+	users := []store.User{}
+	for _, u := range t.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+func (t *testStore) AuthenticateUser(name, password string) (store.ACL, bool) {
+	u, ok := t.users[name]
+	if !ok || t.passwords[name] != password {
+		return store.ACL{}, false
+	}
+	return u.ACL(), true
+}
+
 func doGet(t *testing.T, url, key string) string {
 	resp, err := http.Get(fmt.Sprintf("%s/key/%s", url, key))
 	if err != nil {
@@ -125,6 +1318,28 @@ func doPost(t *testing.T, url, key, value string) {
 	defer resp.Body.Close()
 }
 
+func doCAS(t *testing.T, url, key, body string) int {
+	resp, err := http.Post(fmt.Sprintf("%s/key/%s", url, key), "application-type/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func doTxn(t *testing.T, url, body string) (int, string) {
+	resp, err := http.Post(fmt.Sprintf("%s/txn", url), "application-type/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
 func doDelete(t *testing.T, u, key string) {
 	ru, err := url.Parse(fmt.Sprintf("%s/key/%s", u, key))
 	if err != nil {
@@ -143,6 +1358,50 @@ func doDelete(t *testing.T, u, key string) {
 	defer resp.Body.Close()
 }
 
+func doRemove(t *testing.T, url, body string) int {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/remove", url), strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func doNotify(t *testing.T, url, body string) int {
+	resp, err := http.Post(fmt.Sprintf("%s/notify", url), "application-type/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+// doAuth makes a request presenting the given token, if any, and returns the
+// status code and body of the response.
+func doAuth(t *testing.T, method, url, token, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s request failed: %s", method, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
 func doStatus(t *testing.T, url string) {
 	resp, err := http.Get(fmt.Sprintf("%s/status", url))
 	if err != nil {
@@ -1,17 +1,24 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/otoolep/hraftd/cluster"
 	httpd "github.com/otoolep/hraftd/http"
+	"github.com/otoolep/hraftd/mux"
 	"github.com/otoolep/hraftd/store"
+	"github.com/otoolep/hraftd/tlsutil"
 )
 
 // Command line defaults
@@ -22,19 +29,72 @@ const (
 
 // Command line parameters
 var (
-	inmem    bool
-	httpAddr string
-	raftAddr string
-	joinAddr string
-	nodeID   string
+	inmem        bool
+	httpAddr     string
+	raftAddr     string
+	joinAddr     string
+	nodeID       string
+	redirect     bool
+	nonvoter     bool
+	forceRecover bool
+	muxPort      bool
+
+	joinAttempts int
+	joinInterval time.Duration
+
+	bootstrapExpect        int
+	bootstrapExpectTimeout time.Duration
+
+	discoveryDNS    string
+	discoveryDNSSRV bool
+	discoveryFile   string
+
+	raftTLSCert         string
+	raftTLSKey          string
+	raftTLSCA           string
+	raftTLSVerifyClient bool
+
+	httpTLSCert         string
+	httpTLSKey          string
+	httpTLSCA           string
+	httpTLSVerifyClient bool
+
+	authRootTokenFile string
+
+	autopilot           bool
+	deadServerThreshold time.Duration
+	serverStabilization time.Duration
 )
 
 func init() {
 	flag.BoolVar(&inmem, "inmem", false, "Use in-memory storage for Raft")
 	flag.StringVar(&httpAddr, "haddr", DefaultHTTPAddr, "Set the HTTP bind address")
 	flag.StringVar(&raftAddr, "raddr", DefaultRaftAddr, "Set Raft bind address")
-	flag.StringVar(&joinAddr, "join", "", "Set join address, if any")
+	flag.BoolVar(&muxPort, "mux", false, "Serve Raft on the HTTP bind address, -haddr, instead of on -raddr, so each node needs a single port")
+	flag.StringVar(&raftTLSCert, "raft-tls-cert", "", "Path to the X.509 certificate securing Raft communication with TLS. Also presented to other nodes as a client certificate")
+	flag.StringVar(&raftTLSKey, "raft-tls-key", "", "Path to the private key for -raft-tls-cert")
+	flag.StringVar(&raftTLSCA, "raft-tls-ca", "", "Path to the CA certificate which other nodes' Raft certificates are verified with. If not set, the system roots are used")
+	flag.BoolVar(&raftTLSVerifyClient, "raft-tls-verify-client", false, "Require other nodes connecting for Raft communication to present a certificate")
+	flag.StringVar(&httpTLSCert, "http-tls-cert", "", "Path to the X.509 certificate for serving HTTPS. Reloaded on SIGHUP")
+	flag.StringVar(&httpTLSKey, "http-tls-key", "", "Path to the private key for -http-tls-cert. Reloaded on SIGHUP")
+	flag.StringVar(&httpTLSCA, "http-tls-ca", "", "Path to the CA certificate which HTTPS client certificates, and other nodes' HTTPS certificates, are verified with. If not set, the system roots are used")
+	flag.BoolVar(&httpTLSVerifyClient, "http-tls-verify-client", false, "Require HTTPS clients to present a certificate")
+	flag.StringVar(&authRootTokenFile, "auth-root-token-file", "", "Require every HTTP request to carry an API token, and read the root token, an admin token which must be the same on every node, from this file")
+	flag.StringVar(&joinAddr, "join", "", "Set join addresses, if any, as a comma-separated list")
+	flag.IntVar(&joinAttempts, "join-attempts", 5, "Number of times to try each join address")
+	flag.DurationVar(&joinInterval, "join-interval", time.Second, "Initial time to wait between join attempts, doubled after each attempt")
 	flag.StringVar(&nodeID, "id", "", "Node ID. If not set, same as Raft bind address")
+	flag.IntVar(&bootstrapExpect, "bootstrap-expect", 0, "Bootstrap the cluster once this many nodes, including this one, are reachable via the -join addresses")
+	flag.DurationVar(&bootstrapExpectTimeout, "bootstrap-expect-timeout", 2*time.Minute, "How long to wait for the cluster to be bootstrapped, when -bootstrap-expect is set")
+	flag.StringVar(&discoveryDNS, "discovery-dns", "", "Discover the nodes to join, or bootstrap with, by resolving this DNS name, instead of using -join")
+	flag.BoolVar(&discoveryDNSSRV, "discovery-dns-srv", false, "Resolve -discovery-dns as an SRV record. Otherwise it is resolved to A or AAAA records, and the port of -haddr is used")
+	flag.StringVar(&discoveryFile, "discovery-file", "", "Discover the nodes to join, or bootstrap with, from this JSON file, instead of using -join. The file is watched for changes")
+	flag.BoolVar(&forceRecover, "force-recover", false, "Recover a cluster which has lost its quorum, with this node as its only member, unless peers.json in the Raft storage directory lists the members. Only takes effect once, unless the force-recovered file in the Raft storage directory is removed")
+	flag.BoolVar(&nonvoter, "nonvoter", false, "Join the cluster as a non-voting read replica")
+	flag.BoolVar(&autopilot, "autopilot", false, "Enable the autopilot, which removes dead servers and promotes stable ones")
+	flag.DurationVar(&deadServerThreshold, "autopilot-dead-server-threshold", store.DefaultAutopilotConfig().DeadServerThreshold, "How long a server must be unhealthy before the autopilot removes it")
+	flag.DurationVar(&serverStabilization, "autopilot-stabilization-time", store.DefaultAutopilotConfig().ServerStabilizationTime, "How long a joining server must be healthy before the autopilot promotes it to voter")
+	flag.BoolVar(&redirect, "redirect", false, "Redirect requests which require the leader to it, instead of forwarding them")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <raft-data-path> \n", os.Args[0])
 		flag.PrintDefaults()
@@ -48,6 +108,9 @@ func main() {
 		os.Exit(1)
 	}
 
+	if muxPort {
+		raftAddr = httpAddr
+	}
 	if nodeID == "" {
 		nodeID = raftAddr
 	}
@@ -61,43 +124,215 @@ func main() {
 		log.Fatalf("failed to create path for Raft storage: %s", err.Error())
 	}
 
+	// If HTTPS is enabled, the HTTP APIs of other nodes are reached over
+	// HTTPS too, presenting this node's certificate.
+	var httpCert *tlsutil.Certificate
+	var httpClientTLS *tls.Config
+	if httpTLSCert != "" || httpTLSKey != "" {
+		var err error
+		if httpCert, err = tlsutil.LoadCertificate(httpTLSCert, httpTLSKey); err != nil {
+			log.Fatalf("failed to load HTTPS certificate: %s", err.Error())
+		}
+		if httpClientTLS, err = tlsutil.ClientConfig(httpCert, httpTLSCA); err != nil {
+			log.Fatalf("failed to configure HTTPS client: %s", err.Error())
+		}
+	}
+
+	// Nodes present the root token to each other.
+	var rootToken string
+	if authRootTokenFile != "" {
+		b, err := os.ReadFile(authRootTokenFile)
+		if err != nil {
+			log.Fatalf("failed to read root token: %s", err.Error())
+		}
+		if rootToken = strings.TrimSpace(string(b)); rootToken == "" {
+			log.Fatalf("root token file %s is empty", authRootTokenFile)
+		}
+	}
+
+	// With -mux, Raft and the HTTP API share the HTTP port.
+	var m *mux.Mux
+	if muxPort {
+		ln, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %s", httpAddr, err.Error())
+		}
+		m = mux.New(ln)
+	}
+
 	s := store.New(inmem)
 	s.RaftDir = raftDir
 	s.RaftBind = raftAddr
-	if err := s.Open(joinAddr == "", nodeID); err != nil {
+	s.HTTPAddr = httpAddr
+	s.ForceRecover = forceRecover
+	s.RaftTLSCertFile = raftTLSCert
+	s.RaftTLSKeyFile = raftTLSKey
+	s.RaftTLSCAFile = raftTLSCA
+	s.RaftTLSVerifyClient = raftTLSVerifyClient
+	s.HTTPTLSConfig = httpClientTLS
+	s.HTTPToken = rootToken
+	s.Mux = m
+	if autopilot {
+		s.Autopilot = store.DefaultAutopilotConfig()
+		s.Autopilot.DeadServerThreshold = deadServerThreshold
+		s.Autopilot.ServerStabilizationTime = serverStabilization
+	}
+	disco, err := discoverer()
+	if err != nil {
+		log.Fatalf("failed to configure discovery: %s", err.Error())
+	}
+	if bootstrapExpect > 0 {
+		if disco == nil {
+			log.Fatalln("-bootstrap-expect requires the other nodes to be set with -join, or discovered with -discovery-dns")
+		}
+		s.BootstrapExpect = bootstrapExpect
+	}
+	if err := s.Open(disco == nil, nodeID); err != nil {
 		log.Fatalf("failed to open store: %s", err.Error())
 	}
 
 	h := httpd.New(httpAddr, s)
+	h.Redirect = redirect
+	h.Certificate = httpCert
+	h.CAFile = httpTLSCA
+	h.VerifyClient = httpTLSVerifyClient
+	h.RootToken = rootToken
+	if m != nil {
+		if h.Listener, err = m.Default(); err != nil {
+			log.Fatalf("failed to share HTTP port: %s", err.Error())
+		}
+	}
 	if err := h.Start(); err != nil {
 		log.Fatalf("failed to start HTTP service: %s", err.Error())
 	}
+	if m != nil {
+		go func() {
+			if err := m.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatalf("failed to serve on %s: %s", httpAddr, err.Error())
+			}
+		}()
+	}
 
-	// If join was specified, make the join request.
-	if joinAddr != "" {
-		if err := join(joinAddr, raftAddr, nodeID); err != nil {
-			log.Fatalf("failed to join node at %s: %s", joinAddr, err.Error())
+	// If other nodes were specified, either bootstrap the cluster with them,
+	// or make the join request.
+	hasLeader := func() bool {
+		status, err := s.Status()
+		return err == nil && status.Leader.ID != ""
+	}
+	joiner := cluster.NewJoiner(joinAttempts, joinInterval, httpClientTLS)
+	joiner.Token = rootToken
+	fileDisco, watchFile := disco.(*cluster.FileDiscoverer)
+	if bootstrapExpect > 0 {
+		b := cluster.NewBootstrapper(time.Second, httpClientTLS)
+		b.Token = rootToken
+		if err := b.Boot(disco, nodeID, raftAddr, httpAddr, hasLeader, bootstrapExpectTimeout); err != nil {
+			log.Fatalf("failed to bootstrap cluster: %s", err.Error())
+		}
+	} else if disco != nil {
+		addr, err := joiner.Join(disco, nodeID, raftAddr, httpAddr, !nonvoter)
+		if err != nil && !watchFile {
+			log.Fatalf("failed to join cluster: %s", err.Error())
+		}
+		if err != nil {
+			log.Printf("failed to join cluster, will try again when %s changes: %s", discoveryFile, err.Error())
+		} else {
+			log.Printf("joined cluster via %s", addr)
 		}
 	}
 
+	// Until this node is part of a cluster, try to join the nodes listed in
+	// the discovery file whenever it changes.
+	stopWatch := make(chan struct{})
+	if watchFile {
+		go fileDisco.Watch(time.Second, stopWatch, func() {
+			if hasLeader() {
+				return
+			}
+			log.Printf("%s changed, joining cluster", discoveryFile)
+			addr, err := joiner.Join(disco, nodeID, raftAddr, httpAddr, !nonvoter)
+			if err != nil {
+				log.Printf("failed to join cluster: %s", err.Error())
+				return
+			}
+			log.Printf("joined cluster via %s", addr)
+		})
+	}
+
 	// We're up and running!
-	log.Printf("hraftd started successfully, listening on http://%s", httpAddr)
+	log.Printf("hraftd started successfully, listening on %s://%s", h.Scheme(), httpAddr)
+
+	// Reload the HTTPS certificate on SIGHUP, so it can be rotated without a
+	// restart.
+	if httpCert != nil {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := httpCert.Reload(); err != nil {
+					log.Printf("failed to reload HTTPS certificate: %s", err.Error())
+					continue
+				}
+				log.Println("reloaded HTTPS certificate")
+			}
+		}()
+	}
 
 	terminate := make(chan os.Signal, 1)
-	signal.Notify(terminate, os.Interrupt)
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
 	<-terminate
+	close(stopWatch)
+
+	// Hand off leadership, so the cluster does not wait for an election.
+	if s.IsLeader() {
+		if err := s.TransferLeadership(""); err != nil {
+			log.Printf("failed to transfer leadership: %s", err.Error())
+		}
+	}
+	if err := h.Close(); err != nil {
+		log.Printf("failed to close HTTP service: %s", err.Error())
+	}
+	if err := s.Close(true); err != nil {
+		log.Printf("failed to close store: %s", err.Error())
+	}
+	if m != nil {
+		m.Close()
+	}
 	log.Println("hraftd exiting")
 }
 
-func join(joinAddr, raftAddr, nodeID string) error {
-	b, err := json.Marshal(map[string]string{"addr": raftAddr, "id": nodeID})
-	if err != nil {
-		return err
+// discoverer returns the Discoverer for the other nodes, as configured by the
+// command line, or nil if no other nodes are configured.
+func discoverer() (cluster.Discoverer, error) {
+	if discoveryFile != "" {
+		return &cluster.FileDiscoverer{Path: discoveryFile}, nil
 	}
-	resp, err := http.Post(fmt.Sprintf("http://%s/join", joinAddr), "application-type/json", bytes.NewReader(b))
-	if err != nil {
-		return err
+	if discoveryDNS != "" {
+		d := &cluster.DNSDiscoverer{Name: discoveryDNS, SRV: discoveryDNSSRV}
+		if !d.SRV {
+			_, port, err := net.SplitHostPort(httpAddr)
+			if err != nil {
+				return nil, err
+			}
+			if d.Port, err = strconv.Atoi(port); err != nil {
+				return nil, fmt.Errorf("invalid HTTP port: %s", port)
+			}
+		}
+		return d, nil
+	}
+	if addrs := splitAddrs(joinAddr); len(addrs) > 0 {
+		return cluster.StaticDiscoverer(addrs), nil
+	}
+	return nil, nil
+}
+
+// splitAddrs splits a comma-separated list of addresses, ignoring spaces
+// around each address, and empty entries.
+func splitAddrs(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
 	}
-	defer resp.Body.Close()
-	return nil
+	return addrs
 }
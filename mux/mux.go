@@ -0,0 +1,229 @@
+// Package mux multiplexes a single listener between several services, such as
+// Raft and the HTTP API, by the first byte of every connection.
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the default time a connection has to send its first byte.
+const DefaultTimeout = 10 * time.Second
+
+// Mux routes the connections accepted by a listener to other listeners. A
+// connection whose first byte is a header registered with Listen is routed to
+// that listener, with the header removed. Every other connection is routed,
+// unchanged, to the default listener, if there is one, and closed otherwise.
+// Headers should not be bytes which start the protocol of the default
+// listener, so 0x16 must not be used if it serves TLS, nor printable
+// characters if it serves HTTP.
+type Mux struct {
+	// Timeout is how long a connection has to send its first byte before it
+	// is closed.
+	Timeout time.Duration
+
+	ln net.Listener
+
+	mu        sync.Mutex
+	listeners map[byte]*listener
+	def       *listener
+
+	logger *log.Logger
+}
+
+// New returns a Mux which routes the connections accepted by ln.
+func New(ln net.Listener) *Mux {
+	return &Mux{
+		Timeout:   DefaultTimeout,
+		ln:        ln,
+		listeners: make(map[byte]*listener),
+		logger:    log.New(os.Stderr, "[mux] ", log.LstdFlags),
+	}
+}
+
+// Listen returns a listener for the connections which start with header. The
+// header may be listened for again once the listener is closed.
+func (m *Mux) Listen(header byte) (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.listeners[header]; ok {
+		return nil, fmt.Errorf("header %d already registered", header)
+	}
+	l := m.newListener(func() { delete(m.listeners, header) })
+	m.listeners[header] = l
+	return l, nil
+}
+
+// Default returns a listener for the connections which start with no
+// registered header.
+func (m *Mux) Default() (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.def != nil {
+		return nil, errors.New("default listener already registered")
+	}
+	m.def = m.newListener(func() { m.def = nil })
+	return m.def, nil
+}
+
+// Addr returns the address of the listener.
+func (m *Mux) Addr() net.Addr {
+	return m.ln.Addr()
+}
+
+// Serve accepts connections, and routes them, until the listener is closed.
+// The error from the listener is returned, and every registered listener is
+// closed.
+func (m *Mux) Serve() error {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			m.mu.Lock()
+			for _, l := range m.listeners {
+				l.closeConns()
+			}
+			if m.def != nil {
+				m.def.closeConns()
+			}
+			m.mu.Unlock()
+			return err
+		}
+		go m.route(conn)
+	}
+}
+
+// Close closes the listener, causing Serve to return.
+func (m *Mux) Close() error {
+	return m.ln.Close()
+}
+
+// route reads the first byte of the connection, and hands the connection to
+// the listener for it.
+func (m *Mux) route(conn net.Conn) {
+	var b [1]byte
+	conn.SetReadDeadline(time.Now().Add(m.Timeout))
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	m.mu.Lock()
+	l, ok := m.listeners[b[0]]
+	if !ok && m.def != nil {
+		l = m.def
+		conn = &replayConn{Conn: conn, first: b[0]}
+	}
+	m.mu.Unlock()
+	if l == nil {
+		m.logger.Printf("closing connection from %s with unknown header %d", conn.RemoteAddr(), b[0])
+		conn.Close()
+		return
+	}
+	l.deliver(conn)
+}
+
+// Dial connects to the Mux listening at address, and sends header, so the
+// connection is routed to the listener for header.
+func Dial(address string, header byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte{header}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return conn, nil
+}
+
+// listener is a net.Listener which accepts the connections routed to it by a
+// Mux.
+type listener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+
+	mux *Mux
+
+	// unregister removes the listener from the Mux, and is called with the
+	// Mux locked.
+	unregister func()
+}
+
+func (m *Mux) newListener(unregister func()) *listener {
+	return &listener{
+		addr:       m.ln.Addr(),
+		conns:      make(chan net.Conn),
+		closed:     make(chan struct{}),
+		mux:        m,
+		unregister: unregister,
+	}
+}
+
+// deliver hands the connection to Accept, or closes it if the listener is
+// closed first.
+func (l *listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// closeConns stops the listener accepting connections, without unregistering
+// it. It is called with the Mux locked.
+func (l *listener) closeConns() {
+	l.once.Do(func() { close(l.closed) })
+}
+
+// Accept implements net.Listener.
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener. The Mux, and its listener, are unaffected.
+func (l *listener) Close() error {
+	l.mux.mu.Lock()
+	defer l.mux.mu.Unlock()
+	l.once.Do(func() {
+		close(l.closed)
+		l.unregister()
+	})
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// replayConn is a connection whose first byte, already read, is read again.
+type replayConn struct {
+	net.Conn
+	first    byte
+	replayed bool
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if c.replayed || len(b) == 0 {
+		return c.Conn.Read(b)
+	}
+	c.replayed = true
+	b[0] = c.first
+	return 1, nil
+}
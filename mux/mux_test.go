@@ -0,0 +1,107 @@
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test_Mux tests that connections are routed by their header, and that other
+// connections reach the default listener unchanged.
+func Test_Mux(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	m := New(ln)
+	raftLn, err := m.Listen(1)
+	if err != nil {
+		t.Fatalf("failed to listen for header: %s", err)
+	}
+	if _, err := m.Listen(1); err == nil {
+		t.Fatalf("header registered twice")
+	}
+	httpLn, err := m.Default()
+	if err != nil {
+		t.Fatalf("failed to listen for default: %s", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- m.Serve() }()
+
+	go http.Serve(httpLn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "http")
+	}))
+	resp, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("HTTP request failed: %s", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "http" {
+		t.Fatalf("wrong HTTP response: %s", b)
+	}
+
+	conn, err := Dial(ln.Addr().String(), 1, time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("raft")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	accepted, err := raftLn.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %s", err)
+	}
+	defer accepted.Close()
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(accepted, b); err != nil || string(b) != "raft" {
+		t.Fatalf("wrong data on routed connection: %q, %v", b, err)
+	}
+
+	// A closed listener no longer receives connections, and its header can
+	// be listened for again.
+	raftLn.Close()
+	if _, err := raftLn.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed listener, got: %v", err)
+	}
+	if raftLn, err = m.Listen(1); err != nil {
+		t.Fatalf("failed to listen for header again: %s", err)
+	}
+
+	m.Close()
+	if err := <-served; err == nil {
+		t.Fatalf("serve returned no error after close")
+	}
+	if _, err := raftLn.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed listener, got: %v", err)
+	}
+}
+
+// Test_MuxUnknownHeader tests that connections with an unknown header are
+// closed when there is no default listener.
+func Test_MuxUnknownHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	m := New(ln)
+	defer m.Close()
+	if _, err := m.Listen(1); err != nil {
+		t.Fatalf("failed to listen for header: %s", err)
+	}
+	go m.Serve()
+
+	conn, err := Dial(ln.Addr().String(), 2, time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected connection to be closed, got: %v", err)
+	}
+}
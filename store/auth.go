@@ -0,0 +1,153 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrTokenNotFound is returned when a token does not exist.
+	ErrTokenNotFound = errors.New("token not found")
+
+	// ErrTokenExists is returned when a token is created with the name of
+	// an existing token.
+	ErrTokenExists = errors.New("token already exists")
+)
+
+// ACL grants access to keys, and to the cluster.
+type ACL struct {
+	// Admin grants access to every key, and to the operations which manage
+	// the cluster and its access control.
+	Admin bool `json:"admin,omitempty"`
+
+	// Rules grant access to keys by prefix.
+	Rules []ACLRule `json:"rules,omitempty"`
+}
+
+// ACLRule grants read or write access to every key with Prefix. The empty
+// prefix matches every key.
+type ACLRule struct {
+	Prefix string `json:"prefix"`
+	Read   bool   `json:"read,omitempty"`
+	Write  bool   `json:"write,omitempty"`
+}
+
+// CanRead returns whether the ACL allows every key with the given prefix to
+// be read. For a single key, the prefix is the key itself.
+func (a ACL) CanRead(prefix string) bool {
+	return a.allows(prefix, func(r ACLRule) bool { return r.Read })
+}
+
+// CanWrite returns whether the ACL allows every key with the given prefix to
+// be written. For a single key, the prefix is the key itself.
+func (a ACL) CanWrite(prefix string) bool {
+	return a.allows(prefix, func(r ACLRule) bool { return r.Write })
+}
+
+func (a ACL) allows(prefix string, grants func(ACLRule) bool) bool {
+	if a.Admin {
+		return true
+	}
+	for _, r := range a.Rules {
+		if grants(r) && strings.HasPrefix(prefix, r.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Token is a named API token, and the access it grants. The secret which
+// identifies the token is never stored, only its hash.
+type Token struct {
+	Name string `json:"name"`
+	ACL
+}
+
+// CreateToken creates, via distributed consensus, a token with the given name
+// and ACL. The secret which identifies the token is returned, and cannot be
+// retrieved later.
+func (s *Store) CreateToken(name string, acl ACL) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+
+	c := &command{
+		Op:        "create_token",
+		Token:     &Token{Name: name, ACL: acl},
+		TokenHash: hashToken(secret),
+	}
+	if _, err := s.apply(c); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// DeleteToken deletes, via distributed consensus, the token with the given
+// name.
+func (s *Store) DeleteToken(name string) error {
+	c := &command{
+		Op:    "delete_token",
+		Token: &Token{Name: name},
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// Tokens returns every token, in name order.
+func (s *Store) Tokens() []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens
+}
+
+// AuthenticateToken returns the ACL of the token identified by the given
+// secret. ok is false if there is no such token. This node's local state is
+// used, so a token may be usable on some nodes slightly before others.
+func (s *Store) AuthenticateToken(secret string) (acl ACL, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[hashToken(secret)]
+	return t.ACL, ok
+}
+
+// hashToken returns the hash by which the token with the given secret is
+// stored.
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func (f *fsm) applyCreateToken(hash string, t Token) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, existing := range f.tokens {
+		if existing.Name == t.Name {
+			return ErrTokenExists
+		}
+	}
+	f.tokens[hash] = t
+	return nil
+}
+
+func (f *fsm) applyDeleteToken(name string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for hash, t := range f.tokens {
+		if t.Name == name {
+			delete(f.tokens, hash)
+			return nil
+		}
+	}
+	return ErrTokenNotFound
+}
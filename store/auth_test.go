@@ -0,0 +1,109 @@
+package store
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test_ACL tests that ACL rules grant access by prefix.
+func Test_ACL(t *testing.T) {
+	acl := ACL{Rules: []ACLRule{
+		{Prefix: "app/", Read: true, Write: true},
+		{Prefix: "config/", Read: true},
+	}}
+	tests := []struct {
+		prefix      string
+		read, write bool
+	}{
+		{"app/foo", true, true},
+		{"app/", true, true},
+		{"app", false, false},
+		{"config/foo", true, false},
+		{"other", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		if got := acl.CanRead(tt.prefix); got != tt.read {
+			t.Fatalf("wrong read access to %q: %t", tt.prefix, got)
+		}
+		if got := acl.CanWrite(tt.prefix); got != tt.write {
+			t.Fatalf("wrong write access to %q: %t", tt.prefix, got)
+		}
+	}
+
+	admin := ACL{Admin: true}
+	if !admin.CanRead("") || !admin.CanWrite("") {
+		t.Fatalf("admin denied access")
+	}
+}
+
+// Test_StoreTokens tests that tokens can be created, authenticated and
+// deleted, and survive a snapshot and restore.
+func Test_StoreTokens(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close(true)
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	acl := ACL{Rules: []ACLRule{{Prefix: "app/", Read: true}}}
+	secret, err := s.CreateToken("app", acl)
+	if err != nil {
+		t.Fatalf("failed to create token: %s", err)
+	}
+	if _, err := s.CreateToken("app", ACL{Admin: true}); err != ErrTokenExists {
+		t.Fatalf("expected token to exist, got: %v", err)
+	}
+	if _, err := s.CreateToken("admin", ACL{Admin: true}); err != nil {
+		t.Fatalf("failed to create token: %s", err)
+	}
+
+	got, ok := s.AuthenticateToken(secret)
+	if !ok || !got.CanRead("app/foo") || got.CanWrite("app/foo") {
+		t.Fatalf("token authenticated with wrong ACL: %+v", got)
+	}
+	if _, ok := s.AuthenticateToken("wrong"); ok {
+		t.Fatalf("invalid token authenticated")
+	}
+	if tokens := s.Tokens(); len(tokens) != 2 || tokens[0].Name != "admin" || tokens[1].Name != "app" {
+		t.Fatalf("wrong tokens: %+v", tokens)
+	}
+
+	// Snapshot the store, and restore it into a new FSM.
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot store: %s", err)
+	}
+	sink := &testSnapshotSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	r := New(true)
+	if err := (*fsm)(r).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if _, ok := r.AuthenticateToken(secret); !ok {
+		t.Fatalf("token not restored")
+	}
+
+	if err := s.DeleteToken("app"); err != nil {
+		t.Fatalf("failed to delete token: %s", err)
+	}
+	if err := s.DeleteToken("app"); err != ErrTokenNotFound {
+		t.Fatalf("expected token not to be found, got: %v", err)
+	}
+	if _, ok := s.AuthenticateToken(secret); ok {
+		t.Fatalf("deleted token authenticated")
+	}
+}
@@ -0,0 +1,263 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var (
+	autopilotInterval     = time.Second
+	autopilotFetchTimeout = 2 * time.Second
+)
+
+// AutopilotConfig configures the autopilot, which runs on the leader and
+// manages the membership of the cluster according to the health of each
+// server. A server is healthy if the leader can fetch its stats, it has heard
+// from the leader recently, and its log is not too far behind the leader's.
+type AutopilotConfig struct {
+	// CleanupDeadServers enables the removal of servers which have been
+	// unhealthy for DeadServerThreshold.
+	CleanupDeadServers bool
+
+	// LastContactThreshold is the longest a server may go without hearing
+	// from the leader and still be healthy.
+	LastContactThreshold time.Duration
+
+	// MaxTrailingLogs is the most log entries a server may be behind the
+	// leader and still be healthy.
+	MaxTrailingLogs uint64
+
+	// DeadServerThreshold is how long a server must be unhealthy before it
+	// is removed.
+	DeadServerThreshold time.Duration
+
+	// ServerStabilizationTime is how long a newly joined server must be
+	// healthy before it is promoted to a voter. Until then it joins as a
+	// non-voter. If zero, servers join as voters immediately.
+	ServerStabilizationTime time.Duration
+}
+
+// DefaultAutopilotConfig returns an AutopilotConfig with sensible defaults.
+func DefaultAutopilotConfig() *AutopilotConfig {
+	return &AutopilotConfig{
+		CleanupDeadServers:      true,
+		LastContactThreshold:    10 * time.Second,
+		MaxTrailingLogs:         250,
+		DeadServerThreshold:     5 * time.Minute,
+		ServerStabilizationTime: 10 * time.Second,
+	}
+}
+
+// ServerStats are the Raft statistics of a node, as reported by the node.
+type ServerStats struct {
+	// LastContact is the time since the node last heard from the leader. It
+	// is 0 on the leader, and -1 if the node has never heard from a leader.
+	LastContact time.Duration `json:"last_contact"`
+
+	// LastIndex is the index of the last entry in the node's log.
+	LastIndex uint64 `json:"last_index"`
+
+	// AppliedIndex is the index of the last entry applied to the node's FSM.
+	AppliedIndex uint64 `json:"applied_index"`
+}
+
+// Stats returns the Raft statistics of this node.
+func (s *Store) Stats() ServerStats {
+	stats := ServerStats{
+		LastIndex:    s.raft.LastIndex(),
+		AppliedIndex: s.raft.AppliedIndex(),
+	}
+	if s.raft.State() != raft.Leader {
+		if last := s.raft.LastContact(); last.IsZero() {
+			stats.LastContact = -1
+		} else {
+			stats.LastContact = time.Since(last)
+		}
+	}
+	return stats
+}
+
+// fetchStats fetches the Raft statistics of a node from its HTTP API.
+func (s *Store) fetchStats(httpAddr string) (ServerStats, error) {
+	client := http.Client{Timeout: autopilotFetchTimeout}
+	scheme := "http"
+	if s.HTTPTLSConfig != nil {
+		client.Transport = &http.Transport{
+			TLSClientConfig:   s.HTTPTLSConfig,
+			DisableKeepAlives: true,
+		}
+		scheme = "https"
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/stats", scheme, httpAddr), nil)
+	if err != nil {
+		return ServerStats{}, err
+	}
+	if s.HTTPToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.HTTPToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ServerStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ServerStats{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var stats ServerStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return ServerStats{}, err
+	}
+	return stats, nil
+}
+
+// serverHealth is the health of a server, as tracked by the autopilot.
+type serverHealth struct {
+	healthy bool
+	since   time.Time // When the server last changed health.
+}
+
+// autopilotLoop periodically runs the autopilot while this node is leader.
+func (s *Store) autopilotLoop() {
+	ticker := time.NewTicker(autopilotInterval)
+	defer ticker.Stop()
+
+	health := make(map[string]*serverHealth)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.raft.State() != raft.Leader {
+			// Health is only tracked by the leader. A new leader starts
+			// afresh, so servers must prove themselves to it.
+			health = make(map[string]*serverHealth)
+			continue
+		}
+		if err := s.runAutopilot(health, time.Now()); err != nil {
+			s.logger.Printf("autopilot failed: %s", err)
+		}
+	}
+}
+
+// runAutopilot updates the health of every server, then removes dead servers,
+// and promotes stable servers which are waiting to become voters.
+func (s *Store) runAutopilot(health map[string]*serverHealth, now time.Time) error {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return fmt.Errorf("failed to get raft configuration: %s", err)
+	}
+	servers := configFuture.Configuration().Servers
+
+	lastIndex := s.raft.LastIndex()
+	seen := make(map[string]bool)
+	for _, srv := range servers {
+		id := string(srv.ID)
+		seen[id] = true
+
+		healthy, known := true, true
+		if id != s.localID {
+			healthy, known = s.serverHealthy(id, lastIndex)
+		}
+		if !known {
+			continue
+		}
+		if h, ok := health[id]; !ok || h.healthy != healthy {
+			if ok {
+				s.logger.Printf("autopilot: server %s is now healthy: %v", id, healthy)
+			}
+			health[id] = &serverHealth{healthy: healthy, since: now}
+		}
+	}
+	for id := range health {
+		if !seen[id] {
+			delete(health, id)
+		}
+	}
+
+	if s.Autopilot.CleanupDeadServers {
+		s.removeDeadServers(servers, health, now)
+	}
+
+	s.mu.Lock()
+	pending := make([]string, 0, len(s.pendingVoters))
+	for id := range s.pendingVoters {
+		pending = append(pending, id)
+	}
+	s.mu.Unlock()
+	for _, id := range pending {
+		h, ok := health[id]
+		if !ok || !h.healthy || now.Sub(h.since) < s.Autopilot.ServerStabilizationTime {
+			continue
+		}
+		s.logger.Printf("autopilot: server %s has been stable for %s, promoting", id, now.Sub(h.since))
+		if err := s.Promote(id); err != nil {
+			s.logger.Printf("autopilot: failed to promote server %s: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// serverHealthy returns whether the given server is healthy. known is false if
+// the health of the server cannot be determined, because the address of its
+// HTTP API is not known.
+func (s *Store) serverHealthy(nodeID string, leaderLastIndex uint64) (healthy, known bool) {
+	s.mu.Lock()
+	httpAddr, ok := s.nodes[nodeID]
+	s.mu.Unlock()
+	if !ok {
+		return false, false
+	}
+
+	stats, err := s.statsFetcher(httpAddr)
+	if err != nil {
+		return false, true
+	}
+	if stats.LastContact < 0 || stats.LastContact > s.Autopilot.LastContactThreshold {
+		return false, true
+	}
+	if stats.LastIndex+s.Autopilot.MaxTrailingLogs < leaderLastIndex {
+		return false, true
+	}
+	return true, true
+}
+
+// removeDeadServers removes the servers which have been unhealthy for longer
+// than the dead server threshold. Nothing is removed if at least half the
+// servers are unhealthy, since the leader itself is then more likely to be
+// the problem, for example by being partitioned from the rest of the cluster.
+func (s *Store) removeDeadServers(servers []raft.Server, health map[string]*serverHealth, now time.Time) {
+	var dead []string
+	unhealthy := 0
+	for _, srv := range servers {
+		h, ok := health[string(srv.ID)]
+		if !ok || h.healthy {
+			continue
+		}
+		unhealthy++
+		if now.Sub(h.since) >= s.Autopilot.DeadServerThreshold {
+			dead = append(dead, string(srv.ID))
+		}
+	}
+	if len(dead) == 0 {
+		return
+	}
+	if unhealthy*2 >= len(servers) {
+		s.logger.Printf("autopilot: %d of %d servers are unhealthy, not removing dead servers", unhealthy, len(servers))
+		return
+	}
+
+	for _, id := range dead {
+		s.logger.Printf("autopilot: server %s has been unhealthy for %s, removing", id, now.Sub(health[id].since))
+		if err := s.Remove(id); err != nil {
+			s.logger.Printf("autopilot: failed to remove server %s: %s", id, err)
+			continue
+		}
+		delete(health, id)
+	}
+}
@@ -8,35 +8,214 @@
 package store
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/btree"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/otoolep/hraftd/mux"
+	"github.com/otoolep/hraftd/tlsutil"
 )
 
 const (
 	retainSnapshotCount = 2
 	raftTimeout         = 10 * time.Second
+	expireInterval      = time.Second
+	btreeDegree         = 32
+
+	// peersFile is the name of the file, in RaftDir, which holds the
+	// configuration to recover the cluster with.
+	peersFile = "peers.json"
+
+	// forceRecoveredFile is the name of the file, in RaftDir, which records
+	// that the cluster has been recovered by ForceRecover.
+	forceRecoveredFile = "force-recovered"
+)
+
+var (
+	// ErrNotLeader is returned when a write is sent to a node that is not leader.
+	ErrNotLeader = errors.New("not leader")
+
+	// ErrConflict is returned when the precondition of a compare-and-swap
+	// operation is not met.
+	ErrConflict = errors.New("compare-and-swap precondition failed")
+
+	// ErrNodeNotFound is returned when a node is not a member of the cluster.
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrBootstrapDisabled is returned when a node is notified of a peer, but
+	// is not waiting for the expected number of peers to bootstrap.
+	ErrBootstrapDisabled = errors.New("bootstrap-expect not enabled")
+
+	// ErrTooManyPeers is returned when a node is notified of more peers than
+	// it expects to bootstrap the cluster with.
+	ErrTooManyPeers = errors.New("notified of more nodes than bootstrap-expect")
 )
 
+// ConsistencyLevel is the consistency required of a read.
+type ConsistencyLevel int
+
+const (
+	// ConsistencyNone reads the local state of the node, which may be stale.
+	ConsistencyNone ConsistencyLevel = iota
+
+	// ConsistencyWeak requires the node to believe it is the leader. A
+	// node which has been deposed, but does not yet know it, may still
+	// return stale data.
+	ConsistencyWeak
+
+	// ConsistencyStrong requires the node to confirm with a quorum of the
+	// cluster that it is the leader, and that all committed changes have
+	// been applied, before reading. This is linearizable.
+	ConsistencyStrong
+)
+
+// ParseConsistencyLevel returns the consistency level with the given name,
+// which is one of "none", "weak", or "strong".
+func ParseConsistencyLevel(s string) (ConsistencyLevel, error) {
+	switch s {
+	case "none":
+		return ConsistencyNone, nil
+	case "weak":
+		return ConsistencyWeak, nil
+	case "strong":
+		return ConsistencyStrong, nil
+	default:
+		return ConsistencyNone, fmt.Errorf("unrecognized consistency level: %s", s)
+	}
+}
+
+// String returns the name of the consistency level.
+func (c ConsistencyLevel) String() string {
+	switch c {
+	case ConsistencyNone:
+		return "none"
+	case ConsistencyWeak:
+		return "weak"
+	case ConsistencyStrong:
+		return "strong"
+	default:
+		return fmt.Sprintf("ConsistencyLevel(%d)", int(c))
+	}
+}
+
 type command struct {
-	Op    string `json:"op,omitempty"`
-	Key   string `json:"key,omitempty"`
+	Op          string `json:"op,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Value       string `json:"value,omitempty"`
+	PrevValue   string `json:"prev_value,omitempty"`
+	PrevVersion uint64 `json:"prev_version,omitempty"`
+
+	// Expiration is the deadline of a key being set. The zero value means
+	// the key never expires.
+	Expiration time.Time `json:"expiration,omitempty"`
+
+	// Expired maps the keys to be deleted by an expire command to the modify
+	// index they had when they were found to be expired.
+	Expired map[string]uint64 `json:"expired,omitempty"`
+
+	// NodeID and HTTPAddr identify a node, and the address of its HTTP API.
+	// Pending is whether the node is waiting to be promoted to a voter.
+	NodeID   string `json:"node_id,omitempty"`
+	HTTPAddr string `json:"http_addr,omitempty"`
+	Pending  bool   `json:"pending,omitempty"`
+
+	// Compares and Ops are the conditions and operations of a transaction.
+	// Ops are also the operations of a batch.
+	Compares []Compare `json:"compares,omitempty"`
+	Ops      []Op      `json:"ops,omitempty"`
+
+	// Token is the token being created or deleted, and TokenHash the hash
+	// of the secret of a token being created.
+	Token     *Token `json:"token,omitempty"`
+	TokenHash string `json:"token_hash,omitempty"`
+
+	// User is the user being set or deleted, and PasswordHash the bcrypt
+	// hash of the password of a user being set.
+	User         *User  `json:"user,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// Compare is a condition on the current state of a key, checked as part of a
+// transaction. If Value is set, the key's value must equal it. If Version is
+// set, the key's version must equal it. At least one of them must be set. A
+// key that does not exist has the empty string as its value, and version 0.
+type Compare struct {
+	Key     string  `json:"key"`
+	Value   *string `json:"value,omitempty"`
+	Version *uint64 `json:"version,omitempty"`
+}
+
+// Op is an operation performed as part of a transaction. Op must be "set" or
+// "delete".
+type Op struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
 	Value string `json:"value,omitempty"`
 }
 
+// OpResult is the result of an operation performed as part of a transaction.
+type OpResult struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+
+	// Version and ModifyIndex are the revision metadata of a key after it
+	// was set.
+	Version     uint64 `json:"version,omitempty"`
+	ModifyIndex uint64 `json:"modify_index,omitempty"`
+
+	// Deleted is whether a key existed, and so was deleted.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// TxnResult is the result of a transaction. If any compare failed, Succeeded
+// is false and no operations were performed.
+type TxnResult struct {
+	Succeeded bool       `json:"succeeded"`
+	Results   []OpResult `json:"results"`
+}
+
+// KeyValue is the value of a key, along with its revision metadata.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+
+	// CreateIndex is the index of the Raft log entry which created the key.
+	CreateIndex uint64 `json:"create_index"`
+
+	// ModifyIndex is the index of the Raft log entry which last modified the key.
+	ModifyIndex uint64 `json:"modify_index"`
+
+	// Version is the number of times the key has been set since it was
+	// created. It is reset when the key is deleted.
+	Version uint64 `json:"version"`
+
+	// Expiration is the time after which the key will be deleted. The zero
+	// value means the key never expires.
+	Expiration time.Time `json:"expiration,omitempty"`
+}
+
 // Node represents a node in the cluster.
 type Node struct {
-	ID      string `json:"id"`
-	Address string `json:"address"`
+	ID         string `json:"id"`
+	Address    string `json:"address"`
+	APIAddress string `json:"api_address,omitempty"`
+
+	// Suffrage is "Voter" if the node counts towards the quorum, and
+	// "Nonvoter" otherwise.
+	Suffrage string `json:"suffrage,omitempty"`
 }
 
 // StoreStatus is the Status a Store returns.
@@ -50,23 +229,119 @@ type StoreStatus struct {
 type Store struct {
 	RaftDir  string
 	RaftBind string
-	inmem    bool
+	HTTPAddr string // The address of this node's HTTP API, published to the cluster.
+
+	// RaftTLSCertFile and RaftTLSKeyFile, if set, secure the Raft transport
+	// with TLS. The certificate is presented both when accepting connections
+	// from other nodes, and when connecting to them, so must be valid for
+	// both purposes.
+	RaftTLSCertFile string
+	RaftTLSKeyFile  string
+
+	// RaftTLSCAFile is the CA certificate which the certificates of other
+	// nodes are verified with. If empty, the system roots are used. It may
+	// only be set along with RaftTLSCertFile and RaftTLSKeyFile.
+	RaftTLSCAFile string
+
+	// RaftTLSVerifyClient, if set, requires other nodes connecting to this
+	// node to present a certificate, so only nodes with a certificate signed
+	// by the CA can connect. It may only be set along with RaftTLSCertFile
+	// and RaftTLSKeyFile.
+	RaftTLSVerifyClient bool
+
+	// Mux, if set, is where Raft accepts connections, sharing the port of the
+	// HTTP API, instead of listening on RaftBind. RaftBind must then be the
+	// address of the Mux, and every node must share its port in the same
+	// way.
+	Mux *mux.Mux
+
+	// HTTPTLSConfig, if set, causes the HTTP APIs of other nodes to be
+	// reached over HTTPS, using this configuration.
+	HTTPTLSConfig *tls.Config
+
+	// HTTPToken, if set, is the API token presented to the HTTP APIs of
+	// other nodes.
+	HTTPToken string
+
+	// Autopilot, if set, enables the autopilot with the given configuration.
+	Autopilot *AutopilotConfig
+
+	// BootstrapExpect, if non-zero, is the number of voters the cluster is
+	// bootstrapped with. This node bootstraps the cluster once it has been
+	// notified of that many nodes, including itself, and one of them notifies
+	// it again.
+	BootstrapExpect int
+
+	// ForceRecover, if set, recovers the cluster with this node as its only
+	// voter when the store is opened, unless a peers.json file in RaftDir
+	// gives the nodes to recover with. The cluster is only recovered once: a
+	// force-recovered file is then written to RaftDir, and ForceRecover is
+	// ignored while it exists.
+	ForceRecover bool
+
+	inmem        bool
+	localID      string
+	statsFetcher func(httpAddr string) (ServerStats, error)
+
+	mu    sync.Mutex
+	m     *btree.BTreeG[KeyValue] // The key-value store for the system, ordered by key.
+	nodes map[string]string       // The HTTP API address of each node, by node ID.
+
+	// expiring are the keys which have an expiration, ordered by their
+	// expiration, so expired keys are found without scanning every key.
+	expiring *btree.BTreeG[KeyValue]
+
+	// pendingVoters are the nodes which joined as voters, but are waiting
+	// for the autopilot to promote them once they are stable.
+	pendingVoters map[string]bool
 
-	mu sync.Mutex
-	m  map[string]string // The key-value store for the system.
+	// tokens are the API tokens, by the hash of their secret.
+	tokens map[string]Token
 
-	raft *raft.Raft // The consensus mechanism
+	// users are the users who authenticate with a password, by name.
+	users map[string]userRecord
+
+	// appliedIndex is the index of the last log entry applied.
+	appliedIndex uint64
+
+	// events are the changes made by the log entry being applied, which
+	// are published together once it has been applied.
+	events []Event
+
+	// bootstrapPeers are the nodes this node has been notified of, by node
+	// ID, while waiting to bootstrap.
+	bootstrapPeers map[string]bootstrapPeer
+	bootstrapped   bool
+
+	raft      *raft.Raft // The consensus mechanism
+	transport *raft.NetworkTransport
+	boltDB    *raftboltdb.BoltStore // Nil if the log is stored in memory.
+
+	watches *watchHub // Delivers changes to watchers.
+
+	done      chan struct{}  // Closed to stop background goroutines.
+	closeOnce sync.Once      // Closes done.
+	wg        sync.WaitGroup // Background goroutines.
 
 	logger *log.Logger
 }
 
 // New returns a new Store.
 func New(inmem bool) *Store {
-	return &Store{
-		m:      make(map[string]string),
-		inmem:  inmem,
-		logger: log.New(os.Stderr, "[store] ", log.LstdFlags),
+	s := &Store{
+		m:             newKeyValueTree(),
+		expiring:      newExpirationTree(),
+		nodes:         make(map[string]string),
+		pendingVoters: make(map[string]bool),
+		tokens:        make(map[string]Token),
+		users:         make(map[string]userRecord),
+		watches:       newWatchHub(),
+		done:          make(chan struct{}),
+		inmem:         inmem,
+		logger:        log.New(os.Stderr, "[store] ", log.LstdFlags),
 	}
+	s.statsFetcher = s.fetchStats
+	return s
 }
 
 // Open opens the store. If enableSingle is set, and there are no existing peers,
@@ -76,16 +351,18 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 	// Setup Raft configuration.
 	config := raft.DefaultConfig()
 	config.LocalID = raft.ServerID(localID)
+	s.localID = localID
 
 	// Setup Raft communication.
 	addr, err := net.ResolveTCPAddr("tcp", s.RaftBind)
 	if err != nil {
 		return err
 	}
-	transport, err := raft.NewTCPTransport(s.RaftBind, addr, 3, 10*time.Second, os.Stderr)
+	transport, err := s.newTransport(addr)
 	if err != nil {
 		return err
 	}
+	s.transport = transport
 
 	// Create the snapshot store. This allows the Raft to truncate the log.
 	snapshots, err := raft.NewFileSnapshotStore(s.RaftDir, retainSnapshotCount, os.Stderr)
@@ -108,6 +385,11 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 		}
 		logStore = boltDB
 		stableStore = boltDB
+		s.boltDB = boltDB
+	}
+
+	if err := s.recoverCluster(config, logStore, stableStore, snapshots, transport); err != nil {
+		return err
 	}
 
 	// Instantiate the Raft systems.
@@ -116,8 +398,19 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 		return fmt.Errorf("new raft: %s", err)
 	}
 	s.raft = ra
+	s.runInBackground(s.expireLoop)
+	s.runInBackground(s.observeLeadership)
+	if s.Autopilot != nil {
+		s.runInBackground(s.autopilotLoop)
+	}
 
-	if enableSingle {
+	if s.BootstrapExpect > 0 {
+		s.mu.Lock()
+		s.bootstrapPeers = map[string]bootstrapPeer{
+			localID: {addr: string(transport.LocalAddr()), httpAddr: s.HTTPAddr},
+		}
+		s.mu.Unlock()
+	} else if enableSingle {
 		configuration := raft.Configuration{
 			Servers: []raft.Server{
 				{
@@ -132,56 +425,518 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 	return nil
 }
 
+// newTransport returns the transport for Raft communication, advertising addr
+// to other nodes. The transport is secured with TLS if a certificate is set,
+// and accepts connections from the Mux if it is set.
+func (s *Store) newTransport(addr net.Addr) (*raft.NetworkTransport, error) {
+	secure := s.RaftTLSCertFile != "" || s.RaftTLSKeyFile != ""
+	if !secure && (s.RaftTLSCAFile != "" || s.RaftTLSVerifyClient) {
+		return nil, errors.New("raft TLS: a CA file, or client verification, requires a certificate and key")
+	}
+	if !secure && s.Mux == nil {
+		return raft.NewTCPTransport(s.RaftBind, addr, 3, 10*time.Second, os.Stderr)
+	}
+
+	var serverConfig, clientConfig *tls.Config
+	if secure {
+		cert, err := tlsutil.LoadCertificate(s.RaftTLSCertFile, s.RaftTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("raft TLS: %s", err)
+		}
+		serverConfig, err = tlsutil.ServerConfig(cert, s.RaftTLSCAFile, s.RaftTLSVerifyClient)
+		if err != nil {
+			return nil, fmt.Errorf("raft TLS: %s", err)
+		}
+		clientConfig, err = tlsutil.ClientConfig(cert, s.RaftTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("raft TLS: %s", err)
+		}
+	}
+
+	var ln net.Listener
+	var err error
+	if s.Mux != nil {
+		ln, err = s.Mux.Listen(raftMuxHeader)
+	} else {
+		ln, err = net.Listen("tcp", s.RaftBind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	layer, err := newStreamLayer(ln, addr, serverConfig, clientConfig, s.Mux != nil)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return raft.NewNetworkTransport(layer, 3, 10*time.Second, os.Stderr), nil
+}
+
+// recoverCluster rewrites the Raft configuration stored on disk, if a
+// peers.json file exists in RaftDir, or ForceRecover is set. This allows a
+// cluster which has permanently lost its quorum to be brought back with the
+// surviving nodes. Every surviving node must be recovered with the same
+// configuration. The file is removed once the configuration is rewritten, and
+// a file recording a forced recovery is written, so recovery only happens
+// once, even if ForceRecover stays set.
+func (s *Store) recoverCluster(config *raft.Config, logs raft.LogStore, stable raft.StableStore,
+	snaps raft.SnapshotStore, trans *raft.NetworkTransport) error {
+	path := filepath.Join(s.RaftDir, peersFile)
+	_, err := os.Stat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	havePeers := err == nil
+
+	forcedPath := filepath.Join(s.RaftDir, forceRecoveredFile)
+	_, err = os.Stat(forcedPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	forced := err == nil
+
+	var configuration raft.Configuration
+	if havePeers {
+		configuration, err = raft.ReadConfigJSON(path)
+		if err != nil {
+			return fmt.Errorf("read %s: %s", path, err)
+		}
+	} else if s.ForceRecover && forced {
+		s.logger.Printf("not recovering cluster, since it was already force-recovered: remove %s to recover again", forcedPath)
+		return nil
+	} else if s.ForceRecover {
+		configuration.Servers = []raft.Server{
+			{
+				ID:      config.LocalID,
+				Address: trans.LocalAddr(),
+			},
+		}
+	} else {
+		return nil
+	}
+
+	s.logger.Printf("recovering cluster with %d nodes", len(configuration.Servers))
+	if err := raft.RecoverCluster(config, (*fsm)(s), logs, stable, snaps, trans, configuration); err != nil {
+		return fmt.Errorf("recover cluster: %s", err)
+	}
+	if havePeers {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("remove %s: %s", path, err)
+		}
+	} else if err := os.WriteFile(forcedPath, nil, 0o600); err != nil {
+		return fmt.Errorf("write %s: %s", forcedPath, err)
+	}
+	return nil
+}
+
+// Close closes the store. Raft is shut down, and then the transport and the
+// log store are closed. If wait is set, Close blocks until all of this is
+// done, otherwise it happens in the background. Closing a store which is
+// already closed does nothing.
+func (s *Store) Close(wait bool) error {
+	closed := false
+	s.closeOnce.Do(func() {
+		close(s.done)
+		closed = true
+	})
+	if !closed || s.raft == nil {
+		return nil
+	}
+
+	f := s.raft.Shutdown()
+	closeAll := func() error {
+		s.wg.Wait()
+		if err := f.Error(); err != nil {
+			return fmt.Errorf("shutdown raft: %s", err)
+		}
+		if err := s.transport.Close(); err != nil {
+			return fmt.Errorf("close transport: %s", err)
+		}
+		if s.boltDB != nil {
+			if err := s.boltDB.Close(); err != nil {
+				return fmt.Errorf("close bbolt store: %s", err)
+			}
+		}
+		return nil
+	}
+	if wait {
+		return closeAll()
+	}
+	go func() {
+		if err := closeAll(); err != nil {
+			s.logger.Printf("failed to close store: %s", err)
+		}
+	}()
+	return nil
+}
+
+// runInBackground runs f in a goroutine, which Close waits for. f must return
+// once s.done is closed.
+func (s *Store) runInBackground(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
 // Get returns the value for the given key.
 func (s *Store) Get(key string) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.m[key], nil
+	kv, _ := s.m.Get(KeyValue{Key: key})
+	return kv.Value, nil
 }
 
-// Set sets the value for the given key.
-func (s *Store) Set(key, value string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// GetKeyValue returns the value for the given key, along with its revision
+// metadata. If the key does not exist, ok is false.
+func (s *Store) GetKeyValue(key string) (kv KeyValue, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kv, ok = s.m.Get(KeyValue{Key: key})
+	return kv, ok, nil
+}
+
+// GetWithLevel returns the value for the given key, along with its revision
+// metadata, once the given consistency level has been met. If the key does not
+// exist, ok is false. ErrNotLeader is returned if the level requires the node
+// to be leader, and it is not.
+func (s *Store) GetWithLevel(key string, level ConsistencyLevel) (kv KeyValue, ok bool, err error) {
+	switch level {
+	case ConsistencyNone:
+	case ConsistencyWeak:
+		if s.raft.State() != raft.Leader {
+			return KeyValue{}, false, ErrNotLeader
+		}
+	case ConsistencyStrong:
+		// A barrier is committed through the log, which confirms this
+		// node is still leader, and only completes once all preceding
+		// entries have been applied to the FSM.
+		if s.raft.State() != raft.Leader {
+			return KeyValue{}, false, ErrNotLeader
+		}
+		if err := s.raft.Barrier(raftTimeout).Error(); err != nil {
+			if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+				return KeyValue{}, false, ErrNotLeader
+			}
+			return KeyValue{}, false, err
+		}
+	default:
+		return KeyValue{}, false, fmt.Errorf("unrecognized consistency level: %s", level)
+	}
+	return s.GetKeyValue(key)
+}
+
+// List returns the keys, in order, which have the given prefix and fall
+// within the range [start, end). An empty start or end leaves that side of the
+// range unbounded. At most limit keys are returned, unless limit is 0.
+func (s *Store) List(prefix, start, end string, limit int) ([]KeyValue, error) {
+	if start < prefix {
+		start = prefix
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kvs := []KeyValue{}
+	s.m.AscendGreaterOrEqual(KeyValue{Key: start}, func(kv KeyValue) bool {
+		if !strings.HasPrefix(kv.Key, prefix) || (end != "" && kv.Key >= end) {
+			return false
+		}
+		kvs = append(kvs, kv)
+		return limit == 0 || len(kvs) < limit
+	})
+	return kvs, nil
+}
+
+// Watch returns a watcher for changes to the given key, or to all keys with
+// the given prefix if prefix is set. If index is not 0, changes made at or
+// after that log index are delivered first, as long as they are still in the
+// event history. ErrCompacted is returned if they are not.
+func (s *Store) Watch(key string, prefix bool, index uint64) (Watcher, error) {
+	return s.watches.watch(key, prefix, index)
+}
+
+// Set sets the value for the given key.
+func (s *Store) Set(key, value string) error {
 	c := &command{
 		Op:    "set",
 		Key:   key,
 		Value: value,
 	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
+	_, err := s.apply(c)
+	return err
+}
+
+// SetWithTTL sets the value for the given key, and marks the key to be deleted
+// once ttl has elapsed. The deadline is fixed by this node when the write is
+// made, but the key is only deleted once the leader has committed an expire
+// command for it, so all nodes delete the key at the same point in the log.
+// Until then, reads continue to return the key.
+func (s *Store) SetWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL: %s", ttl)
 	}
 
-	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	c := &command{
+		Op:         "set",
+		Key:        key,
+		Value:      value,
+		Expiration: time.Now().Add(ttl).UTC(),
+	}
+	_, err := s.apply(c)
+	return err
 }
 
-// Delete deletes the given key.
-func (s *Store) Delete(key string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// SetMulti sets the values for all the given keys. The keys are set
+// atomically, in a single Raft log entry.
+func (s *Store) SetMulti(m map[string]string) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ops := make([]Op, len(keys))
+	for i, k := range keys {
+		ops[i] = Op{Op: "set", Key: k, Value: m[k]}
+	}
+	return s.batch(ops)
+}
+
+// CompareAndSwap sets the value for the given key, but only if the current
+// value of the key is prevValue. A key that does not exist has the empty
+// string as its value. ErrConflict is returned if the current value does not
+// match.
+func (s *Store) CompareAndSwap(key, prevValue, value string) error {
+	c := &command{
+		Op:        "cas",
+		Key:       key,
+		Value:     value,
+		PrevValue: prevValue,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// CompareAndSwapVersion sets the value for the given key, but only if the
+// current version of the key is prevVersion. A key that does not exist has
+// version 0. ErrConflict is returned if the current version does not match.
+func (s *Store) CompareAndSwapVersion(key string, prevVersion uint64, value string) error {
+	c := &command{
+		Op:          "cas_version",
+		Key:         key,
+		Value:       value,
+		PrevVersion: prevVersion,
 	}
+	_, err := s.apply(c)
+	return err
+}
+
+// DeleteMulti deletes all the given keys. The keys are deleted atomically, in
+// a single Raft log entry.
+func (s *Store) DeleteMulti(keys []string) error {
+	ops := make([]Op, len(keys))
+	for i, k := range keys {
+		ops[i] = Op{Op: "delete", Key: k}
+	}
+	return s.batch(ops)
+}
 
+// batch performs the given operations in a single Raft log entry.
+func (s *Store) batch(ops []Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	c := &command{
+		Op:  "batch",
+		Ops: ops,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// Txn atomically performs the given operations, but only if all the given
+// compares hold. Either all operations are performed, or none are.
+func (s *Store) Txn(compares []Compare, ops []Op) (TxnResult, error) {
+	for _, c := range compares {
+		if c.Value == nil && c.Version == nil {
+			return TxnResult{}, fmt.Errorf("transaction compare on %q has neither value nor version", c.Key)
+		}
+	}
+	for _, op := range ops {
+		if op.Op != "set" && op.Op != "delete" {
+			return TxnResult{}, fmt.Errorf("unrecognized transaction op: %s", op.Op)
+		}
+		if op.Key == "" {
+			return TxnResult{}, fmt.Errorf("transaction op has no key")
+		}
+	}
+
+	c := &command{
+		Op:       "txn",
+		Compares: compares,
+		Ops:      ops,
+	}
+	r, err := s.apply(c)
+	if err != nil {
+		return TxnResult{}, err
+	}
+	return r.(TxnResult), nil
+}
+
+// Delete deletes the given key.
+func (s *Store) Delete(key string) error {
 	c := &command{
 		Op:  "delete",
 		Key: key,
 	}
+	_, err := s.apply(c)
+	return err
+}
+
+// expireLoop periodically looks for expired keys while this node is the
+// leader, and proposes their deletion through the Raft log.
+func (s *Store) expireLoop() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.raft.State() != raft.Leader {
+			continue
+		}
+		if err := s.expire(time.Now()); err != nil {
+			s.logger.Printf("failed to expire keys: %s", err)
+		}
+	}
+}
+
+// expire proposes the deletion of all keys which expired at or before now.
+func (s *Store) expire(now time.Time) error {
+	expired := make(map[string]uint64)
+	s.mu.Lock()
+	s.expiring.Ascend(func(kv KeyValue) bool {
+		if kv.Expiration.After(now) {
+			return false
+		}
+		expired[kv.Key] = kv.ModifyIndex
+		return true
+	})
+	s.mu.Unlock()
+
+	if len(expired) == 0 {
+		return nil
+	}
+	c := &command{
+		Op:      "expire",
+		Expired: expired,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// apply proposes the given command to the cluster, and returns the response
+// of the FSM once the command has been applied. If the FSM responds with an
+// error, that error is returned.
+func (s *Store) apply(c *command) (interface{}, error) {
+	if s.raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+
 	b, err := json.Marshal(c)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	r := f.Response()
+	if err, ok := r.(error); ok {
+		return nil, err
+	}
+	return r, nil
+}
+
+// bootstrapPeer is a node which has notified this node that it is waiting to
+// bootstrap the cluster.
+type bootstrapPeer struct {
+	addr     string // The Raft address of the node.
+	httpAddr string // The address of the node's HTTP API, if known.
+}
+
+// Notify records that the node, identified by nodeID and located at addr, with
+// its HTTP API at httpAddr, is waiting to bootstrap the cluster. Once
+// BootstrapExpect nodes are known, and one of them other than this node
+// notifies it again, the cluster is bootstrapped with all of them as voters.
+// Waiting for a node to notify again gives every node which is notifying at
+// the same time the chance to notify this node first.
+//
+// Every node which bootstraps must use the same configuration, as Raft
+// requires, so exactly BootstrapExpect nodes must be started with it. If more
+// nodes than that notify this node, it refuses to bootstrap, as the nodes it
+// would choose may differ from those another node chooses, splitting the
+// cluster in two.
+//
+// Whichever node becomes leader publishes the HTTP addresses of the nodes it
+// bootstrapped with, as nodes which form the cluster this way never join.
+func (s *Store) Notify(nodeID, addr, httpAddr string) error {
+	if s.BootstrapExpect == 0 {
+		return ErrBootstrapDisabled
+	}
+
+	s.mu.Lock()
+	if s.bootstrapped {
+		s.mu.Unlock()
+		return nil
+	}
+	_, again := s.bootstrapPeers[nodeID]
+	s.bootstrapPeers[nodeID] = bootstrapPeer{addr: addr, httpAddr: httpAddr}
+	if n := len(s.bootstrapPeers); n > s.BootstrapExpect {
+		s.mu.Unlock()
+		s.logger.Printf("refusing to bootstrap: notified of %d nodes, but expecting %d, so the cluster may split; "+
+			"exactly %d nodes must be started with -bootstrap-expect", n, s.BootstrapExpect, s.BootstrapExpect)
+		return ErrTooManyPeers
+	}
+	if len(s.bootstrapPeers) < s.BootstrapExpect || !again || nodeID == s.localID {
+		s.mu.Unlock()
+		return nil
+	}
+	servers := make([]raft.Server, 0, len(s.bootstrapPeers))
+	for id, p := range s.bootstrapPeers {
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(id),
+			Address: raft.ServerAddress(p.addr),
+		})
+	}
+	s.bootstrapped = true
+	s.mu.Unlock()
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	s.logger.Printf("bootstrapping cluster with %d expected nodes", len(servers))
+	f := s.raft.BootstrapCluster(raft.Configuration{Servers: servers})
+	if err := f.Error(); err != nil && err != raft.ErrCantBootstrap {
+		s.mu.Lock()
+		s.bootstrapped = false
+		s.mu.Unlock()
+		return err
+	}
+	return nil
 }
 
 // Join joins a node, identified by nodeID and located at addr, to this store.
 // The node must be ready to respond to Raft communications at that address.
-func (s *Store) Join(nodeID, addr string) error {
-	s.logger.Printf("received join request for remote node %s at %s", nodeID, addr)
+// If voter is not set, the node joins as a non-voter: it receives all changes,
+// but does not count towards the quorum. If the autopilot requires servers to
+// stabilize, a voter also joins as a non-voter, and is promoted by the
+// autopilot once it has been healthy for long enough.
+func (s *Store) Join(nodeID, addr string, voter bool) error {
+	s.logger.Printf("received join request for remote node %s at %s (voter: %v)", nodeID, addr, voter)
 
 	configFuture := s.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
@@ -196,6 +951,13 @@ func (s *Store) Join(nodeID, addr string) error {
 			// However if *both* the ID and the address are the same, then nothing -- not even
 			// a join operation -- is needed.
 			if srv.Address == raft.ServerAddress(addr) && srv.ID == raft.ServerID(nodeID) {
+				// Unless a non-voter is rejoining as a voter.
+				if voter && srv.Suffrage == raft.Nonvoter {
+					if s.stabilizeVoters() {
+						return s.setPendingVoter(nodeID, true)
+					}
+					return s.Promote(nodeID)
+				}
 				s.logger.Printf("node %s at %s already member of cluster, ignoring join request", nodeID, addr)
 				return nil
 			}
@@ -207,20 +969,266 @@ func (s *Store) Join(nodeID, addr string) error {
 		}
 	}
 
-	f := s.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	var f raft.IndexFuture
+	pending := voter && s.stabilizeVoters()
+	if voter && !pending {
+		f = s.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	} else {
+		f = s.raft.AddNonvoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	}
 	if f.Error() != nil {
 		return f.Error()
 	}
+	if pending {
+		if err := s.setPendingVoter(nodeID, true); err != nil {
+			return err
+		}
+		s.logger.Printf("node %s at %s joined successfully, pending promotion to voter", nodeID, addr)
+		return nil
+	}
 	s.logger.Printf("node %s at %s joined successfully", nodeID, addr)
 	return nil
 }
 
+// stabilizeVoters returns whether joining voters must first be stable for a
+// time, before being promoted by the autopilot.
+func (s *Store) stabilizeVoters() bool {
+	return s.Autopilot != nil && s.Autopilot.ServerStabilizationTime > 0
+}
+
+// setPendingVoter records, via distributed consensus, whether the given node
+// is waiting to be promoted to a voter.
+func (s *Store) setPendingVoter(nodeID string, pending bool) error {
+	s.mu.Lock()
+	current := s.pendingVoters[nodeID]
+	s.mu.Unlock()
+	if current == pending {
+		return nil
+	}
+
+	c := &command{
+		Op:      "set_pending_voter",
+		NodeID:  nodeID,
+		Pending: pending,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// Promote makes the non-voting node, identified by nodeID, a voter. Nothing
+// is done if the node is already a voter.
+func (s *Store) Promote(nodeID string) error {
+	s.logger.Printf("received request to promote node %s", nodeID)
+
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		s.logger.Printf("failed to get raft configuration: %v", err)
+		return err
+	}
+
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID != raft.ServerID(nodeID) {
+			continue
+		}
+		if srv.Suffrage == raft.Voter {
+			s.logger.Printf("node %s is already a voter, ignoring promote request", nodeID)
+			return nil
+		}
+		if err := s.raft.AddVoter(srv.ID, srv.Address, 0, 0).Error(); err != nil {
+			return fmt.Errorf("error promoting node %s: %s", nodeID, err)
+		}
+		if err := s.setPendingVoter(nodeID, false); err != nil {
+			return err
+		}
+		s.logger.Printf("node %s promoted successfully", nodeID)
+		return nil
+	}
+	return ErrNodeNotFound
+}
+
+// Remove removes the node, identified by nodeID, from the cluster. The node's
+// HTTP API address is also removed from the cluster metadata.
+func (s *Store) Remove(nodeID string) error {
+	s.logger.Printf("received request to remove node %s", nodeID)
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		s.logger.Printf("failed to get raft configuration: %v", err)
+		return err
+	}
+	found := false
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(nodeID) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrNodeNotFound
+	}
+
+	if err := s.raft.RemoveServer(raft.ServerID(nodeID), 0, 0).Error(); err != nil {
+		return fmt.Errorf("error removing node %s: %s", nodeID, err)
+	}
+
+	c := &command{
+		Op:     "remove_node",
+		NodeID: nodeID,
+	}
+	if _, err := s.apply(c); err != nil {
+		// The node has been removed, so this is not fatal. A leader
+		// removing itself will no longer be leader by now, for example.
+		s.logger.Printf("failed to remove metadata of node %s: %s", nodeID, err)
+	}
+	s.logger.Printf("node %s removed successfully", nodeID)
+	return nil
+}
+
+// TransferLeadership transfers leadership of the cluster to the node
+// identified by nodeID, or to the most up-to-date voter if nodeID is empty.
+// It returns once the transfer has completed, or failed.
+func (s *Store) TransferLeadership(nodeID string) error {
+	s.logger.Printf("received request to transfer leadership to node %q", nodeID)
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	var f raft.Future
+	if nodeID == "" {
+		f = s.raft.LeadershipTransfer()
+	} else {
+		configFuture := s.raft.GetConfiguration()
+		if err := configFuture.Error(); err != nil {
+			s.logger.Printf("failed to get raft configuration: %v", err)
+			return err
+		}
+		var addr raft.ServerAddress
+		for _, srv := range configFuture.Configuration().Servers {
+			if srv.ID == raft.ServerID(nodeID) {
+				addr = srv.Address
+				break
+			}
+		}
+		if addr == "" {
+			return ErrNodeNotFound
+		}
+		f = s.raft.LeadershipTransferToServer(raft.ServerID(nodeID), addr)
+	}
+	if err := f.Error(); err != nil {
+		return fmt.Errorf("error transferring leadership: %s", err)
+	}
+	s.logger.Printf("leadership transferred successfully")
+	return nil
+}
+
+// SetNodeHTTPAddr records, via distributed consensus, the address of the
+// HTTP API of the given node.
+func (s *Store) SetNodeHTTPAddr(nodeID, httpAddr string) error {
+	s.mu.Lock()
+	current, ok := s.nodes[nodeID]
+	s.mu.Unlock()
+	if ok && current == httpAddr {
+		return nil
+	}
+
+	c := &command{
+		Op:       "set_node",
+		NodeID:   nodeID,
+		HTTPAddr: httpAddr,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// IsLeader returns whether this node is the leader of the cluster.
+func (s *Store) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// LeaderHTTPAddr returns the address of the HTTP API of the current leader,
+// or the empty string if there is no leader, or its address is not known.
+func (s *Store) LeaderHTTPAddr() string {
+	_, id := s.raft.LeaderWithID()
+	if id == "" {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nodes[string(id)]
+}
+
+// observeLeadership publishes the address of this node's HTTP API each time
+// it becomes leader, so that other nodes can always reach the leader. Other
+// nodes have their address published when they join, or, if they bootstrapped
+// the cluster together, by the leader.
+func (s *Store) observeLeadership() {
+	leaderCh := s.raft.LeaderCh()
+	for {
+		var isLeader bool
+		select {
+		case <-s.done:
+			return
+		case isLeader = <-leaderCh:
+		}
+		if !isLeader || s.HTTPAddr == "" {
+			continue
+		}
+		if err := s.SetNodeHTTPAddr(s.localID, s.HTTPAddr); err != nil {
+			s.logger.Printf("failed to publish HTTP address: %s", err)
+		}
+		s.publishBootstrapPeers()
+	}
+}
+
+// publishBootstrapPeers publishes the addresses of the HTTP APIs of the nodes
+// this node was notified of while waiting to bootstrap, which are still
+// members of the cluster.
+func (s *Store) publishBootstrapPeers() {
+	s.mu.Lock()
+	peers := make(map[string]string, len(s.bootstrapPeers))
+	for id, p := range s.bootstrapPeers {
+		if id != s.localID && p.httpAddr != "" {
+			peers[id] = p.httpAddr
+		}
+	}
+	s.mu.Unlock()
+	if len(peers) == 0 {
+		return
+	}
+
+	f := s.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		s.logger.Printf("failed to get raft configuration: %v", err)
+		return
+	}
+	for _, srv := range f.Configuration().Servers {
+		httpAddr, ok := peers[string(srv.ID)]
+		if !ok {
+			continue
+		}
+		if err := s.SetNodeHTTPAddr(string(srv.ID), httpAddr); err != nil {
+			s.logger.Printf("failed to publish HTTP address of %s: %s", srv.ID, err)
+		}
+	}
+}
+
 // Status returns information about the Store.
 func (s *Store) Status() (StoreStatus, error) {
 	leaderServerAddr, leaderId := s.raft.LeaderWithID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	leader := Node{
-		ID:      string(leaderId),
-		Address: string(leaderServerAddr),
+		ID:         string(leaderId),
+		Address:    string(leaderServerAddr),
+		APIAddress: s.nodes[string(leaderId)],
+	}
+	if leaderId != "" {
+		// Only voters can be elected leader.
+		leader.Suffrage = raft.Voter.String()
 	}
 
 	servers := s.raft.GetConfiguration().Configuration().Servers
@@ -231,15 +1239,19 @@ func (s *Store) Status() (StoreStatus, error) {
 	for _, server := range servers {
 		if server.ID != leaderId {
 			followers = append(followers, Node{
-				ID:      string(server.ID),
-				Address: string(server.Address),
+				ID:         string(server.ID),
+				Address:    string(server.Address),
+				APIAddress: s.nodes[string(server.ID)],
+				Suffrage:   server.Suffrage.String(),
 			})
 		}
 
 		if string(server.Address) == s.RaftBind {
 			me = Node{
-				ID:      string(server.ID),
-				Address: string(server.Address),
+				ID:         string(server.ID),
+				Address:    string(server.Address),
+				APIAddress: s.nodes[string(server.ID)],
+				Suffrage:   server.Suffrage.String(),
 			}
 		}
 	}
@@ -262,11 +1274,40 @@ func (f *fsm) Apply(l *raft.Log) interface{} {
 		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
 	}
 
+	f.mu.Lock()
+	f.appliedIndex = l.Index
+	f.mu.Unlock()
+	defer f.publishEvents()
+
 	switch c.Op {
 	case "set":
-		return f.applySet(c.Key, c.Value)
+		return f.applySet(l.Index, c.Key, c.Value, c.Expiration)
+	case "cas":
+		return f.applyCompareAndSwap(l.Index, c.Key, c.PrevValue, c.Value)
+	case "cas_version":
+		return f.applyCompareAndSwapVersion(l.Index, c.Key, c.PrevVersion, c.Value)
 	case "delete":
-		return f.applyDelete(c.Key)
+		return f.applyDelete(l.Index, c.Key)
+	case "expire":
+		return f.applyExpire(l.Index, c.Expired)
+	case "txn":
+		return f.applyTxn(l.Index, c.Compares, c.Ops)
+	case "batch":
+		return f.applyBatch(l.Index, c.Ops)
+	case "set_node":
+		return f.applySetNode(c.NodeID, c.HTTPAddr)
+	case "remove_node":
+		return f.applyRemoveNode(c.NodeID)
+	case "set_pending_voter":
+		return f.applySetPendingVoter(c.NodeID, c.Pending)
+	case "create_token":
+		return f.applyCreateToken(c.TokenHash, *c.Token)
+	case "delete_token":
+		return f.applyDeleteToken(c.Token.Name)
+	case "set_user":
+		return f.applySetUser(c.PasswordHash, *c.User)
+	case "delete_user":
+		return f.applyDeleteUser(c.User.Name)
 	default:
 		panic(fmt.Sprintf("unrecognized command op: %s", c.Op))
 	}
@@ -277,49 +1318,357 @@ func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Clone the map.
-	o := make(map[string]string)
-	for k, v := range f.m {
-		o[k] = v
+	// Clone the node metadata.
+	nodes := make(map[string]string)
+	for k, v := range f.nodes {
+		nodes[k] = v
+	}
+	pending := make([]string, 0, len(f.pendingVoters))
+	for k := range f.pendingVoters {
+		pending = append(pending, k)
+	}
+	sort.Strings(pending)
+	tokens := make(map[string]Token)
+	for k, v := range f.tokens {
+		tokens[k] = v
 	}
-	return &fsmSnapshot{store: o}, nil
+	users := make(map[string]userRecord)
+	for k, v := range f.users {
+		users[k] = v
+	}
+
+	// Clone the tree. This is a lazy copy-on-write, so is cheap.
+	return &fsmSnapshot{
+		store:         f.m.Clone(),
+		index:         f.appliedIndex,
+		nodes:         nodes,
+		pendingVoters: pending,
+		tokens:        tokens,
+		users:         users,
+	}, nil
+}
+
+// snapshot is the encoded form of a snapshot. The key-values are in key order.
+type snapshot struct {
+	KV            []KeyValue            `json:"kv"`
+	Index         uint64                `json:"index,omitempty"`
+	Nodes         map[string]string     `json:"nodes,omitempty"`
+	PendingVoters []string              `json:"pending_voters,omitempty"`
+	Tokens        map[string]Token      `json:"tokens,omitempty"`
+	Users         map[string]userRecord `json:"users,omitempty"`
 }
 
 // Restore stores the key-value store to a previous state.
 func (f *fsm) Restore(rc io.ReadCloser) error {
-	o := make(map[string]string)
-	if err := json.NewDecoder(rc).Decode(&o); err != nil {
+	r := make(map[string]json.RawMessage)
+	if err := json.NewDecoder(rc).Decode(&r); err != nil {
 		return err
 	}
 
-	// Set the state from the snapshot, no lock required according to
-	// Hashicorp docs.
+	var snap snapshot
+	if b, ok := r["kv"]; ok && len(b) > 0 && b[0] == '[' {
+		// Snapshots written by older versions map keys directly to
+		// values, so never contain a list.
+		if err := json.Unmarshal(b, &snap.KV); err != nil {
+			return err
+		}
+		if b, ok := r["index"]; ok {
+			if err := json.Unmarshal(b, &snap.Index); err != nil {
+				return err
+			}
+		}
+		if b, ok := r["nodes"]; ok {
+			if err := json.Unmarshal(b, &snap.Nodes); err != nil {
+				return err
+			}
+		}
+		if b, ok := r["pending_voters"]; ok {
+			if err := json.Unmarshal(b, &snap.PendingVoters); err != nil {
+				return err
+			}
+		}
+		if b, ok := r["tokens"]; ok {
+			if err := json.Unmarshal(b, &snap.Tokens); err != nil {
+				return err
+			}
+		}
+		if b, ok := r["users"]; ok {
+			if err := json.Unmarshal(b, &snap.Users); err != nil {
+				return err
+			}
+		}
+	} else if err := decodeLegacySnapshot(r, &snap); err != nil {
+		return err
+	}
+
+	o := newKeyValueTree()
+	expiring := newExpirationTree()
+	for _, kv := range snap.KV {
+		o.ReplaceOrInsert(kv)
+		if !kv.Expiration.IsZero() {
+			expiring.ReplaceOrInsert(kv)
+		}
+	}
+	nodes := snap.Nodes
+	if nodes == nil {
+		nodes = make(map[string]string)
+	}
+	pending := make(map[string]bool)
+	for _, id := range snap.PendingVoters {
+		pending[id] = true
+	}
+	tokens := snap.Tokens
+	if tokens == nil {
+		tokens = make(map[string]Token)
+	}
+	users := snap.Users
+	if users == nil {
+		users = make(map[string]userRecord)
+	}
+
+	// Set the state from the snapshot. Restore never runs at the same
+	// time as Apply, according to Hashicorp docs, but reads, such as Get,
+	// do.
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.m = o
+	f.expiring = expiring
+	f.nodes = nodes
+	f.pendingVoters = pending
+	f.tokens = tokens
+	f.users = users
+	f.appliedIndex = snap.Index
+	f.watches.reset(snap.Index)
+	return nil
+}
+
+// decodeLegacySnapshot decodes a snapshot written by an older version, which
+// maps each key to either its value, or its KeyValue.
+func decodeLegacySnapshot(r map[string]json.RawMessage, snap *snapshot) error {
+	for k, b := range r {
+		var kv KeyValue
+		if len(b) > 0 && b[0] == '"' {
+			// Snapshots written by older versions map keys directly to
+			// values, without any revision metadata.
+			kv = KeyValue{Key: k, Version: 1}
+			if err := json.Unmarshal(b, &kv.Value); err != nil {
+				return err
+			}
+		} else if err := json.Unmarshal(b, &kv); err != nil {
+			return err
+		}
+		snap.KV = append(snap.KV, kv)
+	}
+	return nil
+}
+
+func (f *fsm) applySet(index uint64, key, value string, expiration time.Time) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(index, key, value, expiration)
+	return nil
+}
+
+func (f *fsm) applyCompareAndSwap(index uint64, key, prevValue, value string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if kv, _ := f.m.Get(KeyValue{Key: key}); kv.Value != prevValue {
+		return ErrConflict
+	}
+	f.set(index, key, value, time.Time{})
+	return nil
+}
+
+func (f *fsm) applyCompareAndSwapVersion(index uint64, key string, prevVersion uint64, value string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if kv, _ := f.m.Get(KeyValue{Key: key}); kv.Version != prevVersion {
+		return ErrConflict
+	}
+	f.set(index, key, value, time.Time{})
+	return nil
+}
+
+func (f *fsm) applyDelete(index uint64, key string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delete(index, key)
 	return nil
 }
 
-func (f *fsm) applySet(key, value string) interface{} {
+// applyExpire deletes the given keys. A key is only deleted if it has not been
+// modified since the leader found it to be expired.
+func (f *fsm) applyExpire(index uint64, expired map[string]uint64) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, idx := range expired {
+		if kv, ok := f.m.Get(KeyValue{Key: k}); ok && kv.ModifyIndex == idx {
+			f.delete(index, k)
+		}
+	}
+	return nil
+}
+
+func (f *fsm) applyTxn(index uint64, compares []Compare, ops []Op) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range compares {
+		kv, _ := f.m.Get(KeyValue{Key: c.Key})
+		if c.Value != nil && kv.Value != *c.Value {
+			return TxnResult{Results: []OpResult{}}
+		}
+		if c.Version != nil && kv.Version != *c.Version {
+			return TxnResult{Results: []OpResult{}}
+		}
+	}
+
+	return TxnResult{Succeeded: true, Results: f.applyOps(index, ops)}
+}
+
+func (f *fsm) applyBatch(index uint64, ops []Op) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applyOps(index, ops)
+	return nil
+}
+
+// applyOps performs the given operations, and returns their results. It must
+// be called with the mutex held.
+func (f *fsm) applyOps(index uint64, ops []Op) []OpResult {
+	results := make([]OpResult, len(ops))
+	for i, op := range ops {
+		results[i] = OpResult{Op: op.Op, Key: op.Key}
+		switch op.Op {
+		case "set":
+			results[i].Version = f.set(index, op.Key, op.Value, time.Time{}).Version
+			results[i].ModifyIndex = index
+		case "delete":
+			results[i].Deleted = f.delete(index, op.Key)
+		default:
+			panic(fmt.Sprintf("unrecognized op: %s", op.Op))
+		}
+	}
+	return results
+}
+
+func (f *fsm) applySetNode(nodeID, httpAddr string) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.m[key] = value
+	f.nodes[nodeID] = httpAddr
 	return nil
 }
 
-func (f *fsm) applyDelete(key string) interface{} {
+func (f *fsm) applyRemoveNode(nodeID string) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	delete(f.m, key)
+	delete(f.nodes, nodeID)
+	delete(f.pendingVoters, nodeID)
 	return nil
 }
 
+func (f *fsm) applySetPendingVoter(nodeID string, pending bool) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pending {
+		f.pendingVoters[nodeID] = true
+	} else {
+		delete(f.pendingVoters, nodeID)
+	}
+	return nil
+}
+
+// publishEvents publishes the changes made by the log entry just applied, all
+// together, so watchers never see only some of the changes made by a batch or
+// transaction.
+func (f *fsm) publishEvents() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.events) > 0 {
+		f.watches.publish(f.events)
+		f.events = nil
+	}
+}
+
+// set sets the value for the given key, updating its revision metadata, and
+// returns the new state of the key. It must be called with the mutex held.
+func (f *fsm) set(index uint64, key, value string, expiration time.Time) KeyValue {
+	kv, ok := f.m.Get(KeyValue{Key: key})
+	if !ok {
+		kv = KeyValue{Key: key, CreateIndex: index}
+	}
+	if !kv.Expiration.IsZero() {
+		f.expiring.Delete(kv)
+	}
+	kv.Value = value
+	kv.ModifyIndex = index
+	kv.Version++
+	kv.Expiration = expiration
+	f.m.ReplaceOrInsert(kv)
+	if !kv.Expiration.IsZero() {
+		f.expiring.ReplaceOrInsert(kv)
+	}
+	f.events = append(f.events, Event{Type: "set", Index: index, KV: kv})
+	return kv
+}
+
+// delete deletes the given key, and returns whether it existed. It must be
+// called with the mutex held.
+func (f *fsm) delete(index uint64, key string) bool {
+	kv, ok := f.m.Delete(KeyValue{Key: key})
+	if !ok {
+		return false
+	}
+	if !kv.Expiration.IsZero() {
+		f.expiring.Delete(kv)
+	}
+	f.events = append(f.events, Event{Type: "delete", Index: index, KV: KeyValue{Key: key, ModifyIndex: index}})
+	return true
+}
+
+// newKeyValueTree returns an empty tree of key-values, ordered by key.
+func newKeyValueTree() *btree.BTreeG[KeyValue] {
+	return btree.NewG(btreeDegree, func(a, b KeyValue) bool {
+		return a.Key < b.Key
+	})
+}
+
+// newExpirationTree returns an empty tree of key-values, ordered by
+// expiration, and then by key.
+func newExpirationTree() *btree.BTreeG[KeyValue] {
+	return btree.NewG(btreeDegree, func(a, b KeyValue) bool {
+		if !a.Expiration.Equal(b.Expiration) {
+			return a.Expiration.Before(b.Expiration)
+		}
+		return a.Key < b.Key
+	})
+}
+
 type fsmSnapshot struct {
-	store map[string]string
+	store         *btree.BTreeG[KeyValue]
+	index         uint64 // The index of the last log entry in the snapshot.
+	nodes         map[string]string
+	pendingVoters []string
+	tokens        map[string]Token
+	users         map[string]userRecord
 }
 
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
 		// Encode data.
-		b, err := json.Marshal(f.store)
+		snap := snapshot{
+			KV:            make([]KeyValue, 0, f.store.Len()),
+			Index:         f.index,
+			Nodes:         f.nodes,
+			PendingVoters: f.pendingVoters,
+			Tokens:        f.tokens,
+			Users:         f.users,
+		}
+		f.store.Ascend(func(kv KeyValue) bool {
+			snap.KV = append(snap.KV, kv)
+			return true
+		})
+		b, err := json.Marshal(snap)
 		if err != nil {
 			return err
 		}
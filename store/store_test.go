@@ -1,7 +1,15 @@
 package store
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -171,3 +179,1215 @@ func Test_StoreStatus(t *testing.T) {
 		t.Errorf("me must be exist exclusively as a leader or as a follower")
 	}
 }
+
+// Test_StoreCompareAndSwap tests that a compare-and-swap only succeeds when
+// the precondition is met.
+func Test_StoreCompareAndSwap(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.CompareAndSwap("foo", "", "bar"); err != nil {
+		t.Fatalf("failed to swap non-existent key: %s", err.Error())
+	}
+	if err := s.CompareAndSwap("foo", "baz", "qux"); err != ErrConflict {
+		t.Fatalf("expected conflict, got: %v", err)
+	}
+	value, err := s.Get("foo")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err.Error())
+	}
+	if value != "bar" {
+		t.Fatalf("key has wrong value: %s", value)
+	}
+
+	if err := s.CompareAndSwap("foo", "bar", "qux"); err != nil {
+		t.Fatalf("failed to swap key: %s", err.Error())
+	}
+	value, err = s.Get("foo")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err.Error())
+	}
+	if value != "qux" {
+		t.Fatalf("key has wrong value: %s", value)
+	}
+}
+
+// Test_StoreRevisions tests that revision metadata is maintained for keys, and
+// survives a snapshot and restore.
+func Test_StoreRevisions(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	kv1, ok, err := s.GetKeyValue("foo")
+	if err != nil || !ok {
+		t.Fatalf("failed to get key: %v", err)
+	}
+	if kv1.Version != 1 || kv1.CreateIndex == 0 || kv1.CreateIndex != kv1.ModifyIndex {
+		t.Fatalf("key has wrong revision metadata: %+v", kv1)
+	}
+
+	if err := s.CompareAndSwapVersion("foo", 0, "baz"); err != ErrConflict {
+		t.Fatalf("expected conflict, got: %v", err)
+	}
+	if err := s.CompareAndSwapVersion("foo", 1, "baz"); err != nil {
+		t.Fatalf("failed to swap key: %s", err.Error())
+	}
+	kv2, _, _ := s.GetKeyValue("foo")
+	if kv2.Version != 2 || kv2.CreateIndex != kv1.CreateIndex || kv2.ModifyIndex <= kv1.ModifyIndex {
+		t.Fatalf("key has wrong revision metadata: %+v", kv2)
+	}
+
+	// Snapshot the store, and restore it into a new FSM.
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot store: %s", err)
+	}
+	sink := &testSnapshotSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	r := New(true)
+	if err := (*fsm)(r).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	kv3, ok, _ := r.GetKeyValue("foo")
+	if !ok || kv3 != kv2 {
+		t.Fatalf("restored key has wrong value: %+v", kv3)
+	}
+}
+
+// Test_StoreRestoreConcurrentRead tests that keys can be read while a snapshot
+// is restored, as happens when a follower installs a snapshot from the leader.
+func Test_StoreRestoreConcurrentRead(t *testing.T) {
+	s := New(true)
+	snap := []byte(`{"kv":[{"key":"foo","value":"bar","create_index":1,"modify_index":1,"version":1}],"index":1}`)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := (*fsm)(s).Restore(io.NopCloser(bytes.NewReader(snap))); err != nil {
+				t.Errorf("failed to restore snapshot: %s", err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if kv, ok, _ := s.GetKeyValue("foo"); !ok || kv.Value != "bar" {
+				t.Fatalf("restored key has wrong value: %+v", kv)
+			}
+			return
+		default:
+			if kv, ok, _ := s.GetKeyValue("foo"); ok && kv.Value != "bar" {
+				t.Fatalf("key read during restore has wrong value: %+v", kv)
+			}
+		}
+	}
+}
+
+type testSnapshotSink struct {
+	bytes.Buffer
+}
+
+func (t *testSnapshotSink) ID() string    { return "test" }
+func (t *testSnapshotSink) Cancel() error { return nil }
+func (t *testSnapshotSink) Close() error  { return nil }
+
+// Test_StoreSetWithTTL tests that keys set with a TTL are deleted once the
+// TTL has elapsed.
+func Test_StoreSetWithTTL(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.SetWithTTL("foo", "bar", time.Second); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	if err := s.SetWithTTL("qux", "baz", time.Hour); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	kv, ok, _ := s.GetKeyValue("foo")
+	if !ok || kv.Expiration.IsZero() {
+		t.Fatalf("key has no expiration: %+v", kv)
+	}
+
+	// Wait for the key to be expired by the leader.
+	time.Sleep(3 * time.Second)
+	if _, ok, _ := s.GetKeyValue("foo"); ok {
+		t.Fatalf("key was not expired")
+	}
+	if _, ok, _ := s.GetKeyValue("qux"); !ok {
+		t.Fatalf("key was expired early")
+	}
+
+	// Setting a key without a TTL clears any expiration.
+	if err := s.Set("qux", "baz"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	if kv, _, _ := s.GetKeyValue("qux"); !kv.Expiration.IsZero() {
+		t.Fatalf("key has expiration: %+v", kv)
+	}
+	if n := s.expiring.Len(); n != 0 {
+		t.Fatalf("wrong number of expiring keys: %d", n)
+	}
+
+	// Expiring keys are found again once a snapshot is restored.
+	if err := s.SetWithTTL("foo", "bar", time.Hour); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot store: %s", err)
+	}
+	sink := &testSnapshotSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	r := New(true)
+	if err := (*fsm)(r).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if kv, ok := r.expiring.Min(); !ok || kv.Key != "foo" || r.expiring.Len() != 1 {
+		t.Fatalf("wrong expiring keys after restore: %+v", kv)
+	}
+}
+
+// Test_StoreTxn tests that transactions are applied atomically.
+func Test_StoreTxn(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	prev := "baz"
+	res, err := s.Txn([]Compare{{Key: "foo", Value: &prev}}, []Op{{Op: "set", Key: "qux", Value: "1"}})
+	if err != nil {
+		t.Fatalf("failed to apply transaction: %s", err.Error())
+	}
+	if res.Succeeded {
+		t.Fatalf("transaction succeeded despite failed compare")
+	}
+	if _, ok, _ := s.GetKeyValue("qux"); ok {
+		t.Fatalf("failed transaction set key")
+	}
+
+	prev = "bar"
+	var version uint64 = 1
+	res, err = s.Txn([]Compare{{Key: "foo", Value: &prev, Version: &version}}, []Op{
+		{Op: "set", Key: "qux", Value: "1"},
+		{Op: "delete", Key: "foo"},
+		{Op: "delete", Key: "nonexistent"},
+	})
+	if err != nil {
+		t.Fatalf("failed to apply transaction: %s", err.Error())
+	}
+	if !res.Succeeded || len(res.Results) != 3 {
+		t.Fatalf("transaction has wrong result: %+v", res)
+	}
+	if res.Results[0].Version != 1 || !res.Results[1].Deleted || res.Results[2].Deleted {
+		t.Fatalf("transaction has wrong op results: %+v", res.Results)
+	}
+	if v, _ := s.Get("qux"); v != "1" {
+		t.Fatalf("key has wrong value: %s", v)
+	}
+	if _, ok, _ := s.GetKeyValue("foo"); ok {
+		t.Fatalf("transaction did not delete key")
+	}
+
+	if _, err := s.Txn(nil, []Op{{Op: "get", Key: "foo"}}); err == nil {
+		t.Fatalf("transaction with unrecognized op succeeded")
+	}
+	if _, err := s.Txn([]Compare{{Key: "qux"}}, []Op{{Op: "delete", Key: "qux"}}); err == nil {
+		t.Fatalf("transaction with empty compare succeeded")
+	}
+	if _, ok, _ := s.GetKeyValue("qux"); !ok {
+		t.Fatalf("transaction with empty compare deleted key")
+	}
+}
+
+// Test_StoreBatch tests that multiple keys can be set and deleted in a single
+// log entry.
+func Test_StoreBatch(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.SetMulti(map[string]string{"a": "1", "b": "2", "c": "3"}); err != nil {
+		t.Fatalf("failed to set keys: %s", err.Error())
+	}
+	a, _, _ := s.GetKeyValue("a")
+	c, _, _ := s.GetKeyValue("c")
+	if a.Value != "1" || c.Value != "3" {
+		t.Fatalf("keys have wrong values: %+v, %+v", a, c)
+	}
+	if a.ModifyIndex != c.ModifyIndex {
+		t.Fatalf("keys not set in a single log entry: %d, %d", a.ModifyIndex, c.ModifyIndex)
+	}
+
+	if err := s.DeleteMulti([]string{"a", "b"}); err != nil {
+		t.Fatalf("failed to delete keys: %s", err.Error())
+	}
+	if _, ok, _ := s.GetKeyValue("a"); ok {
+		t.Fatalf("key a not deleted")
+	}
+	if _, ok, _ := s.GetKeyValue("b"); ok {
+		t.Fatalf("key b not deleted")
+	}
+	if _, ok, _ := s.GetKeyValue("c"); !ok {
+		t.Fatalf("key c deleted")
+	}
+}
+
+// Test_StoreList tests that keys can be listed in order, by prefix and range.
+func Test_StoreList(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.SetMulti(map[string]string{"a": "0", "b/1": "1", "b/3": "3", "b/2": "2", "c": "4"}); err != nil {
+		t.Fatalf("failed to set keys: %s", err.Error())
+	}
+
+	for _, tt := range []struct {
+		prefix, start, end string
+		limit              int
+		exp                string
+	}{
+		{"", "", "", 0, "a,b/1,b/2,b/3,c"},
+		{"b/", "", "", 0, "b/1,b/2,b/3"},
+		{"b/", "", "", 2, "b/1,b/2"},
+		{"b/", "b/2", "", 0, "b/2,b/3"},
+		{"b/", "", "b/3", 0, "b/1,b/2"},
+		{"", "b", "c", 0, "b/1,b/2,b/3"},
+		{"d", "", "", 0, ""},
+	} {
+		kvs, err := s.List(tt.prefix, tt.start, tt.end, tt.limit)
+		if err != nil {
+			t.Fatalf("failed to list keys: %s", err.Error())
+		}
+		keys := []string{}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		if got := strings.Join(keys, ","); got != tt.exp {
+			t.Fatalf("wrong keys for %+v: %s", tt, got)
+		}
+	}
+}
+
+// Test_StoreWatch tests that watchers receive changes to keys, and that
+// recent changes can be replayed from the event history.
+func Test_StoreWatch(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	w, err := s.Watch("a/", true, 0)
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer w.Close()
+
+	if err := s.Set("a/1", "x"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	if err := s.Set("b/1", "y"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	if err := s.Delete("a/1"); err != nil {
+		t.Fatalf("failed to delete key: %s", err.Error())
+	}
+
+	var first Event
+	for i, exp := range []string{"set", "delete"} {
+		select {
+		case ev := <-w.Events():
+			if ev.Type != exp || ev.KV.Key != "a/1" {
+				t.Fatalf("wrong event received: %+v", ev)
+			}
+			if i == 0 {
+				first = ev
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event")
+		}
+	}
+
+	// A new watcher on the key replays history from the given index.
+	w2, err := s.Watch("a/1", false, first.Index)
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer w2.Close()
+	for _, exp := range []string{"set", "delete"} {
+		select {
+		case ev := <-w2.Events():
+			if ev.Type != exp {
+				t.Fatalf("wrong event replayed: %+v", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for replayed event")
+		}
+	}
+
+	// The changes made by a batch are delivered together.
+	if err := s.SetMulti(map[string]string{"a/2": "x", "a/3": "y"}); err != nil {
+		t.Fatalf("failed to set keys: %s", err.Error())
+	}
+	select {
+	case ev := <-w.Events():
+		select {
+		case ev2 := <-w.Events():
+			if ev2.Index != ev.Index {
+				t.Fatalf("batch events have different indexes: %d, %d", ev.Index, ev2.Index)
+			}
+		default:
+			t.Fatalf("batch event not delivered with the first")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+
+	w.Close()
+	if _, ok := <-w.Events(); ok {
+		t.Fatalf("closed watcher received event")
+	}
+}
+
+// Test_StoreWatchRestore tests that a watch cannot start from an index covered
+// by a restored snapshot, since the events leading up to it are lost.
+func Test_StoreWatchRestore(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close(true)
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	for _, v := range []string{"x", "y", "z"} {
+		if err := s.Set("a", v); err != nil {
+			t.Fatalf("failed to set key: %s", err.Error())
+		}
+	}
+	kv, _, _ := s.GetKeyValue("a")
+
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot store: %s", err)
+	}
+	sink := &testSnapshotSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	if err := (*fsm)(s).Restore(io.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+
+	if _, err := s.Watch("a", false, kv.CreateIndex); err != ErrCompacted {
+		t.Fatalf("expected watch from before snapshot to be compacted, got: %v", err)
+	}
+	if _, err := s.Watch("a", false, kv.ModifyIndex); err != ErrCompacted {
+		t.Fatalf("expected watch from last snapshot index to be compacted, got: %v", err)
+	}
+	w, err := s.Watch("a", false, kv.ModifyIndex+1)
+	if err != nil {
+		t.Fatalf("failed to watch from after snapshot: %s", err)
+	}
+	w.Close()
+
+	// A snapshot written by an older version does not record its index, so
+	// no watch can start from an index until the next change.
+	legacy := map[string]json.RawMessage{}
+	if err := json.Unmarshal(sink.Bytes(), &legacy); err != nil {
+		t.Fatalf("failed to decode snapshot: %s", err)
+	}
+	delete(legacy, "index")
+	b, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %s", err)
+	}
+	if err := (*fsm)(s).Restore(io.NopCloser(bytes.NewReader(b))); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if _, err := s.Watch("a", false, kv.ModifyIndex+1); err != ErrCompacted {
+		t.Fatalf("expected watch after legacy restore to be compacted, got: %v", err)
+	}
+	if err := s.Set("a", "w"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	kv, _, _ = s.GetKeyValue("a")
+	w, err = s.Watch("a", false, kv.ModifyIndex)
+	if err != nil {
+		t.Fatalf("failed to watch after change: %s", err)
+	}
+	defer w.Close()
+	select {
+	case ev := <-w.Events():
+		if ev.KV.Value != "w" {
+			t.Fatalf("wrong event replayed: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for replayed event")
+	}
+}
+
+// Test_StoreGetWithLevel tests that reads at each consistency level succeed on
+// the leader, and that reads requiring leadership fail on a node which is not
+// leader.
+func Test_StoreGetWithLevel(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	for _, l := range []string{"none", "weak", "strong"} {
+		level, err := ParseConsistencyLevel(l)
+		if err != nil {
+			t.Fatalf("failed to parse consistency level: %s", err)
+		}
+		kv, ok, err := s.GetWithLevel("foo", level)
+		if err != nil || !ok || kv.Value != "bar" {
+			t.Fatalf("failed to get key at level %s: %+v, %v", level, kv, err)
+		}
+	}
+	if _, err := ParseConsistencyLevel("bogus"); err == nil {
+		t.Fatalf("parsed bogus consistency level")
+	}
+
+	// A node which has not joined any cluster is never leader.
+	f := New(true)
+	tmpDir2, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir2)
+	f.RaftBind = "127.0.0.1:0"
+	f.RaftDir = tmpDir2
+	if err := f.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	if _, _, err := f.GetWithLevel("foo", ConsistencyNone); err != nil {
+		t.Fatalf("failed to get key at level none: %s", err)
+	}
+	if _, _, err := f.GetWithLevel("foo", ConsistencyWeak); err != ErrNotLeader {
+		t.Fatalf("expected not leader error at level weak, got: %v", err)
+	}
+	if _, _, err := f.GetWithLevel("foo", ConsistencyStrong); err != ErrNotLeader {
+		t.Fatalf("expected not leader error at level strong, got: %v", err)
+	}
+}
+
+// Test_StoreMultiNode tests that a node can join a cluster, receives changes
+// made on the leader, and knows the HTTP address of the leader.
+func Test_StoreMultiNode(t *testing.T) {
+	s0 := New(true)
+	tmpDir0, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = mustFreeAddr(t)
+	s0.RaftDir = tmpDir0
+	s0.HTTPAddr = "127.0.0.1:11000"
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if addr := s0.LeaderHTTPAddr(); addr != "127.0.0.1:11000" {
+		t.Fatalf("leader has wrong HTTP address: %s", addr)
+	}
+
+	s1 := New(true)
+	tmpDir1, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir1)
+	s1.RaftBind = mustFreeAddr(t)
+	s1.RaftDir = tmpDir1
+	s1.HTTPAddr = "127.0.0.1:11001"
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	if err := s0.Join("node1", s1.RaftBind, true); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	if err := s0.SetNodeHTTPAddr("node1", s1.HTTPAddr); err != nil {
+		t.Fatalf("failed to set node HTTP address: %s", err)
+	}
+	if err := s0.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	// Wait for the changes to be replicated.
+	time.Sleep(2 * time.Second)
+
+	if s1.IsLeader() {
+		t.Fatalf("joining node is leader")
+	}
+	if v, _ := s1.Get("foo"); v != "bar" {
+		t.Fatalf("key not replicated to joining node: %s", v)
+	}
+	if addr := s1.LeaderHTTPAddr(); addr != "127.0.0.1:11000" {
+		t.Fatalf("joining node has wrong leader HTTP address: %s", addr)
+	}
+	status, err := s1.Status()
+	if err != nil {
+		t.Fatalf("failed to get status: %s", err)
+	}
+	if status.Me.APIAddress != "127.0.0.1:11001" {
+		t.Fatalf("status has wrong API address: %s", status.Me.APIAddress)
+	}
+
+	// Remove the joined node.
+	if err := s1.Remove("node1"); err != ErrNotLeader {
+		t.Fatalf("expected not leader error removing node on follower, got: %v", err)
+	}
+	if err := s0.Remove("node1"); err != nil {
+		t.Fatalf("failed to remove node: %s", err)
+	}
+	if err := s0.Remove("node1"); err != ErrNodeNotFound {
+		t.Fatalf("expected node not found error, got: %v", err)
+	}
+	status, err = s0.Status()
+	if err != nil {
+		t.Fatalf("failed to get status: %s", err)
+	}
+	if len(status.Followers) != 0 {
+		t.Fatalf("removed node still in cluster: %+v", status.Followers)
+	}
+	s0.mu.Lock()
+	_, ok := s0.nodes["node1"]
+	s0.mu.Unlock()
+	if ok {
+		t.Fatalf("removed node still has HTTP address")
+	}
+}
+
+// mustFreeAddr returns a local address with a port which is free to bind.
+// Nodes in a multi-node cluster must advertise a real port, so cannot bind
+// to port 0.
+func mustFreeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find free port: %s", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// Test_StoreNonvoter tests that a node can join as a non-voter, receives
+// changes, and can be promoted to a voter.
+func Test_StoreNonvoter(t *testing.T) {
+	s0 := New(true)
+	tmpDir0, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = mustFreeAddr(t)
+	s0.RaftDir = tmpDir0
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	s1 := New(true)
+	tmpDir1, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir1)
+	s1.RaftBind = mustFreeAddr(t)
+	s1.RaftDir = tmpDir1
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	if err := s0.Join("node1", s1.RaftBind, false); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	if err := s0.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	// Wait for the changes to be replicated.
+	time.Sleep(2 * time.Second)
+
+	if v, _ := s1.Get("foo"); v != "bar" {
+		t.Fatalf("key not replicated to non-voter: %s", v)
+	}
+	status, err := s0.Status()
+	if err != nil {
+		t.Fatalf("failed to get status: %s", err)
+	}
+	if len(status.Followers) != 1 || status.Followers[0].Suffrage != "Nonvoter" {
+		t.Fatalf("status has wrong followers: %+v", status.Followers)
+	}
+	if status.Leader.Suffrage != "Voter" {
+		t.Fatalf("status has wrong leader suffrage: %s", status.Leader.Suffrage)
+	}
+
+	if err := s0.Promote("node2"); err != ErrNodeNotFound {
+		t.Fatalf("expected node not found error, got: %v", err)
+	}
+	if err := s0.Promote("node1"); err != nil {
+		t.Fatalf("failed to promote node: %s", err)
+	}
+	status, err = s0.Status()
+	if err != nil {
+		t.Fatalf("failed to get status: %s", err)
+	}
+	if status.Followers[0].Suffrage != "Voter" {
+		t.Fatalf("node not promoted: %+v", status.Followers)
+	}
+}
+
+// Test_StoreAutopilot tests that the autopilot promotes joining servers once
+// they are stable, and removes dead servers.
+func Test_StoreAutopilot(t *testing.T) {
+	var mu sync.Mutex
+	dead := make(map[string]bool)
+
+	s0 := New(true)
+	tmpDir0, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = mustFreeAddr(t)
+	s0.RaftDir = tmpDir0
+	s0.Autopilot = &AutopilotConfig{
+		CleanupDeadServers:      true,
+		LastContactThreshold:    10 * time.Second,
+		MaxTrailingLogs:         100,
+		DeadServerThreshold:     2 * time.Second,
+		ServerStabilizationTime: 2 * time.Second,
+	}
+	s0.statsFetcher = func(httpAddr string) (ServerStats, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if dead[httpAddr] {
+			return ServerStats{}, fmt.Errorf("connection refused")
+		}
+		return ServerStats{LastIndex: s0.raft.LastIndex()}, nil
+	}
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	for _, id := range []string{"node1", "node2"} {
+		s := New(true)
+		tmpDir, _ := os.MkdirTemp("", "store_test")
+		defer os.RemoveAll(tmpDir)
+		s.RaftBind = mustFreeAddr(t)
+		s.RaftDir = tmpDir
+		if err := s.Open(false, id); err != nil {
+			t.Fatalf("failed to open store: %s", err)
+		}
+		if err := s0.Join(id, s.RaftBind, true); err != nil {
+			t.Fatalf("failed to join node: %s", err)
+		}
+		if err := s0.SetNodeHTTPAddr(id, id+":11000"); err != nil {
+			t.Fatalf("failed to set node HTTP address: %s", err)
+		}
+	}
+
+	suffrage := func() map[string]string {
+		status, err := s0.Status()
+		if err != nil {
+			t.Fatalf("failed to get status: %s", err)
+		}
+		m := make(map[string]string)
+		for _, n := range status.Followers {
+			m[n.ID] = n.Suffrage
+		}
+		return m
+	}
+	if m := suffrage(); m["node1"] != "Nonvoter" || m["node2"] != "Nonvoter" {
+		t.Fatalf("joining nodes not added as non-voters: %v", m)
+	}
+
+	// Wait for the joining nodes to stabilize.
+	time.Sleep(5 * time.Second)
+	if m := suffrage(); m["node1"] != "Voter" || m["node2"] != "Voter" {
+		t.Fatalf("stable nodes not promoted: %v", m)
+	}
+	s0.mu.Lock()
+	n := len(s0.pendingVoters)
+	s0.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("promoted nodes still pending")
+	}
+
+	mu.Lock()
+	dead["node2:11000"] = true
+	mu.Unlock()
+
+	// Wait for the dead node to be removed.
+	time.Sleep(5 * time.Second)
+	if m := suffrage(); len(m) != 1 || m["node1"] != "Voter" {
+		t.Fatalf("dead node not removed: %v", m)
+	}
+}
+
+// Test_StoreTransferLeadership tests that leadership can be transferred to
+// another node.
+func Test_StoreTransferLeadership(t *testing.T) {
+	s0 := New(true)
+	tmpDir0, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = mustFreeAddr(t)
+	s0.RaftDir = tmpDir0
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	s1 := New(true)
+	tmpDir1, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir1)
+	s1.RaftBind = mustFreeAddr(t)
+	s1.RaftDir = tmpDir1
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	if err := s0.Join("node1", s1.RaftBind, true); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+
+	// Wait for the node to catch up.
+	time.Sleep(2 * time.Second)
+
+	if err := s0.TransferLeadership("node2"); err != ErrNodeNotFound {
+		t.Fatalf("expected node not found error, got: %v", err)
+	}
+	if err := s1.TransferLeadership(""); err != ErrNotLeader {
+		t.Fatalf("expected not leader error, got: %v", err)
+	}
+	if err := s0.TransferLeadership("node1"); err != nil {
+		t.Fatalf("failed to transfer leadership: %s", err)
+	}
+
+	// Wait for the new leader to take over.
+	time.Sleep(2 * time.Second)
+	if !s1.IsLeader() || s0.IsLeader() {
+		t.Fatalf("leadership not transferred")
+	}
+}
+
+// Test_StoreClose tests that a closed store can be reopened, recovering its
+// state from disk.
+func Test_StoreClose(t *testing.T) {
+	s := New(false)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftBind = mustFreeAddr(t)
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	if err := s.Close(true); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+	if err := s.Close(true); err != nil {
+		t.Fatalf("failed to close store a second time: %s", err)
+	}
+	if err := s.Set("foo", "baz"); err == nil {
+		t.Fatalf("set key on closed store")
+	}
+
+	s = New(false)
+	s.RaftBind = mustFreeAddr(t)
+	s.RaftDir = tmpDir
+	if err := s.Open(false, "node0"); err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	defer s.Close(true)
+
+	// Wait for the log to be replayed.
+	time.Sleep(3 * time.Second)
+	value, err := s.Get("foo")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err.Error())
+	}
+	if value != "bar" {
+		t.Fatalf("key has wrong value after reopen: %s", value)
+	}
+
+	// Concurrent closes must not race, and a close which does not wait must
+	// not block.
+	errs := make(chan error, 2)
+	go func() { errs <- s.Close(true) }()
+	go func() { errs <- s.Close(false) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to close store concurrently: %s", err)
+		}
+	}
+}
+
+// Test_StoreBootstrapExpect tests that a cluster is bootstrapped once the
+// expected number of nodes have been notified, and that the HTTP address of
+// every node is published.
+func Test_StoreBootstrapExpect(t *testing.T) {
+	stores := make([]*Store, 3)
+	for i := range stores {
+		s := New(true)
+		tmpDir, _ := os.MkdirTemp("", "store_test")
+		defer os.RemoveAll(tmpDir)
+		s.RaftBind = mustFreeAddr(t)
+		s.RaftDir = tmpDir
+		s.HTTPAddr = fmt.Sprintf("localhost:1100%d", i)
+		s.BootstrapExpect = len(stores)
+		if err := s.Open(false, fmt.Sprintf("node%d", i)); err != nil {
+			t.Fatalf("failed to open store: %s", err)
+		}
+		defer s.Close(true)
+		stores[i] = s
+	}
+
+	// Notify the first node of only one other node.
+	if err := stores[0].Notify("node1", stores[1].RaftBind, stores[1].HTTPAddr); err != nil {
+		t.Fatalf("failed to notify: %s", err)
+	}
+	time.Sleep(3 * time.Second)
+	for i, s := range stores {
+		if status, _ := s.Status(); status.Leader.ID != "" {
+			t.Fatalf("node%d has a leader before all nodes are known", i)
+		}
+	}
+
+	// Every node notifies every node twice, as a node waits to be notified
+	// again before bootstrapping.
+	for round := 0; round < 2; round++ {
+		for _, s := range stores {
+			for j, peer := range stores {
+				if err := s.Notify(fmt.Sprintf("node%d", j), peer.RaftBind, peer.HTTPAddr); err != nil {
+					t.Fatalf("failed to notify: %s", err)
+				}
+			}
+		}
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+	leaders := 0
+	for i, s := range stores {
+		status, err := s.Status()
+		if err != nil {
+			t.Fatalf("failed to get status: %s", err)
+		}
+		if status.Leader.ID == "" || len(status.Followers) != 2 {
+			t.Fatalf("node%d has wrong status: %+v", i, status)
+		}
+		if s.IsLeader() {
+			leaders++
+		}
+		for _, n := range append(status.Followers, status.Leader) {
+			if n.APIAddress != "localhost:1100"+strings.TrimPrefix(n.ID, "node") {
+				t.Fatalf("node%d has wrong HTTP address for %s: %q", i, n.ID, n.APIAddress)
+			}
+		}
+	}
+	if leaders != 1 {
+		t.Fatalf("wrong number of leaders: %d", leaders)
+	}
+
+	s := New(true)
+	if err := s.Notify("node1", "127.0.0.1:0", ""); err != ErrBootstrapDisabled {
+		t.Fatalf("expected bootstrap disabled error, got: %v", err)
+	}
+}
+
+// Test_StoreBootstrapExpectTooMany tests that a node refuses to bootstrap the
+// cluster once more nodes than expected have notified it.
+func Test_StoreBootstrapExpectTooMany(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftBind = mustFreeAddr(t)
+	s.RaftDir = tmpDir
+	s.BootstrapExpect = 2
+	if err := s.Open(false, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close(true)
+
+	if err := s.Notify("node1", mustFreeAddr(t), ""); err != nil {
+		t.Fatalf("failed to notify: %s", err)
+	}
+	if err := s.Notify("node2", mustFreeAddr(t), ""); err != ErrTooManyPeers {
+		t.Fatalf("expected too many peers error, got: %v", err)
+	}
+	if err := s.Notify("node1", mustFreeAddr(t), ""); err != ErrTooManyPeers {
+		t.Fatalf("expected too many peers error once notified again, got: %v", err)
+	}
+
+	time.Sleep(3 * time.Second)
+	if status, _ := s.Status(); status.Leader.ID != "" {
+		t.Fatalf("store bootstrapped with too many nodes: %+v", status)
+	}
+}
+
+// Test_StoreRecover tests that a node which has lost its quorum can be
+// recovered from a peers.json file.
+func Test_StoreRecover(t *testing.T) {
+	s0 := New(false)
+	tmpDir0, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = mustFreeAddr(t)
+	s0.RaftDir = tmpDir0
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	s1 := New(true)
+	tmpDir1, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir1)
+	s1.RaftBind = mustFreeAddr(t)
+	s1.RaftDir = tmpDir1
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	if err := s0.Join("node1", s1.RaftBind, true); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	if err := s0.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	// Lose node1 for good, so node0 has no quorum when it restarts.
+	if err := s1.Close(true); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+	if err := s0.Close(true); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+
+	s0 = New(false)
+	s0.RaftBind = mustFreeAddr(t)
+	s0.RaftDir = tmpDir0
+	peers := fmt.Sprintf(`[{"id": "node0", "address": %q}]`, s0.RaftBind)
+	if err := os.WriteFile(filepath.Join(tmpDir0, "peers.json"), []byte(peers), 0o600); err != nil {
+		t.Fatalf("failed to write peers.json: %s", err)
+	}
+	if err := s0.Open(false, "node0"); err != nil {
+		t.Fatalf("failed to recover store: %s", err)
+	}
+	defer s0.Close(true)
+	if _, err := os.Stat(filepath.Join(tmpDir0, "peers.json")); !os.IsNotExist(err) {
+		t.Fatalf("peers.json not removed after recovery")
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+	if !s0.IsLeader() {
+		t.Fatalf("recovered node is not leader")
+	}
+	value, err := s0.Get("foo")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err.Error())
+	}
+	if value != "bar" {
+		t.Fatalf("key has wrong value after recovery: %s", value)
+	}
+}
+
+// Test_StoreForceRecover tests that a node which has lost its quorum can be
+// recovered as the only member of the cluster, and that this only happens
+// once, even if the node is started with ForceRecover again.
+func Test_StoreForceRecover(t *testing.T) {
+	s0 := New(false)
+	tmpDir0, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = mustFreeAddr(t)
+	s0.RaftDir = tmpDir0
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	s1 := New(true)
+	tmpDir1, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir1)
+	s1.RaftBind = mustFreeAddr(t)
+	s1.RaftDir = tmpDir1
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	if err := s0.Join("node1", s1.RaftBind, true); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	if err := s0.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	// Lose node1 for good, so node0 has no quorum when it restarts.
+	if err := s1.Close(true); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+	if err := s0.Close(true); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+
+	s0 = New(false)
+	s0.RaftBind = mustFreeAddr(t)
+	s0.RaftDir = tmpDir0
+	s0.ForceRecover = true
+	if err := s0.Open(false, "node0"); err != nil {
+		t.Fatalf("failed to recover store: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir0, forceRecoveredFile)); err != nil {
+		t.Fatalf("forced recovery not recorded: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+	if !s0.IsLeader() {
+		t.Fatalf("recovered node is not leader")
+	}
+	if value, _ := s0.Get("foo"); value != "bar" {
+		t.Fatalf("key has wrong value after recovery: %s", value)
+	}
+
+	// Grow the cluster again, then restart node0 with ForceRecover still
+	// set. The new membership must be kept.
+	s2 := New(true)
+	tmpDir2, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir2)
+	s2.RaftBind = mustFreeAddr(t)
+	s2.RaftDir = tmpDir2
+	if err := s2.Open(false, "node2"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s2.Close(true)
+	if err := s0.Join("node2", s2.RaftBind, true); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	raftBind := s0.RaftBind
+	if err := s0.Close(true); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+
+	s0 = New(false)
+	s0.RaftBind = raftBind
+	s0.RaftDir = tmpDir0
+	s0.ForceRecover = true
+	if err := s0.Open(false, "node0"); err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	defer s0.Close(true)
+	f := s0.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		t.Fatalf("failed to get configuration: %s", err)
+	}
+	if servers := f.Configuration().Servers; len(servers) != 2 {
+		t.Fatalf("membership lost by restart with ForceRecover: %+v", servers)
+	}
+}
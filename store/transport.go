@@ -0,0 +1,95 @@
+package store
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/otoolep/hraftd/mux"
+)
+
+// raftMuxHeader is the first byte of every Raft connection made to a node
+// which shares its port, through a mux.Mux, with the HTTP API. No HTTP request,
+// or TLS handshake, starts with it.
+const raftMuxHeader byte = 1
+
+// streamLayer is a raft.StreamLayer which accepts connections from a listener,
+// which may be fed by a mux.Mux, and may secure connections between nodes with
+// TLS.
+type streamLayer struct {
+	net.Listener
+	advertise net.Addr
+
+	// clientConfig secures outgoing connections. It is nil if connections
+	// are not secured.
+	clientConfig *tls.Config
+
+	// mux is whether other nodes share their port through a mux.Mux, so
+	// outgoing connections must start with raftMuxHeader.
+	mux bool
+}
+
+// newStreamLayer returns a streamLayer accepting connections from ln, and
+// advertising advertise to other nodes. If serverConfig is set, incoming
+// connections are secured with it, and outgoing connections with
+// clientConfig.
+func newStreamLayer(ln net.Listener, advertise net.Addr, serverConfig, clientConfig *tls.Config, mux bool) (*streamLayer, error) {
+	tcpAddr, ok := advertise.(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("local address is not a TCP address")
+	}
+	if tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() {
+		return nil, errors.New("local bind address is not advertisable")
+	}
+
+	if serverConfig != nil {
+		ln = tls.NewListener(ln, serverConfig)
+	}
+	return &streamLayer{
+		Listener:     ln,
+		advertise:    advertise,
+		clientConfig: clientConfig,
+		mux:          mux,
+	}, nil
+}
+
+// Dial implements raft.StreamLayer.
+func (l *streamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if l.mux {
+		conn, err = mux.Dial(string(address), raftMuxHeader, timeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", string(address), timeout)
+	}
+	if err != nil || l.clientConfig == nil {
+		return conn, err
+	}
+
+	// Verify the certificate against the host dialed, as tls.Dial does.
+	config := l.clientConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(string(address))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Addr implements raft.StreamLayer.
+func (l *streamLayer) Addr() net.Addr {
+	return l.advertise
+}
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/otoolep/hraftd/internal/tlstest"
+	"github.com/otoolep/hraftd/mux"
+)
+
+// Test_StoreTLS tests that nodes can replicate over a TLS transport, and that
+// a node without a certificate signed by the CA cannot take part.
+func Test_StoreTLS(t *testing.T) {
+	files := tlstest.Write(t, t.TempDir())
+	newTLSStore := func(files tlstest.Files) *Store {
+		s := New(true)
+		s.RaftBind = mustFreeAddr(t)
+		s.RaftDir = t.TempDir()
+		s.RaftTLSCertFile = files.Cert
+		s.RaftTLSKeyFile = files.Key
+		s.RaftTLSCAFile = files.CA
+		s.RaftTLSVerifyClient = true
+		return s
+	}
+
+	s0 := newTLSStore(files)
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s0.Close(true)
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	s1 := newTLSStore(files)
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s1.Close(true)
+	if err := s0.Join("node1", s1.RaftBind, true); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+
+	// A node with a certificate from another CA.
+	s2 := newTLSStore(tlstest.Write(t, t.TempDir()))
+	if err := s2.Open(false, "node2"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s2.Close(true)
+	if err := s0.Join("node2", s2.RaftBind, false); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+
+	if err := s0.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	// Wait for the nodes to catch up.
+	time.Sleep(2 * time.Second)
+	if value, _ := s1.Get("foo"); value != "bar" {
+		t.Fatalf("key not replicated over TLS: %q", value)
+	}
+	if value, _ := s2.Get("foo"); value != "" {
+		t.Fatalf("key replicated to node with untrusted certificate")
+	}
+
+	s := New(true)
+	s.RaftBind = mustFreeAddr(t)
+	s.RaftDir = t.TempDir()
+	s.RaftTLSCertFile = files.Cert
+	s.RaftTLSKeyFile = os.DevNull
+	if err := s.Open(true, "node3"); err == nil {
+		t.Fatalf("opened store with invalid key")
+	}
+
+	s = New(true)
+	s.RaftBind = mustFreeAddr(t)
+	s.RaftDir = t.TempDir()
+	s.RaftTLSCAFile = files.CA
+	if err := s.Open(true, "node4"); err == nil {
+		t.Fatalf("opened store with a CA file, but no certificate")
+	}
+
+	s = New(true)
+	s.RaftBind = mustFreeAddr(t)
+	s.RaftDir = t.TempDir()
+	s.RaftTLSVerifyClient = true
+	if err := s.Open(true, "node5"); err == nil {
+		t.Fatalf("opened store verifying clients, but with no certificate")
+	}
+}
+
+// Test_StoreMux tests that nodes can replicate through a mux.Mux, with and
+// without TLS, while the port also serves HTTP.
+func Test_StoreMux(t *testing.T) {
+	testStoreMux(t, false)
+	testStoreMux(t, true)
+}
+
+func testStoreMux(t *testing.T, secure bool) {
+	files := tlstest.Write(t, t.TempDir())
+	newMuxStore := func() *Store {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %s", err)
+		}
+		m := mux.New(ln)
+		t.Cleanup(func() { m.Close() })
+		httpLn, err := m.Default()
+		if err != nil {
+			t.Fatalf("failed to listen for HTTP: %s", err)
+		}
+		go http.Serve(httpLn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "http")
+		}))
+		go m.Serve()
+
+		s := New(true)
+		s.RaftBind = ln.Addr().String()
+		s.RaftDir = t.TempDir()
+		s.Mux = m
+		if secure {
+			s.RaftTLSCertFile = files.Cert
+			s.RaftTLSKeyFile = files.Key
+			s.RaftTLSCAFile = files.CA
+			s.RaftTLSVerifyClient = true
+		}
+		return s
+	}
+
+	s0 := newMuxStore()
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s0.Close(true)
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	s1 := newMuxStore()
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s1.Close(true)
+	if err := s0.Join("node1", s1.RaftBind, true); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	if err := s0.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	// Wait for the node to catch up.
+	time.Sleep(2 * time.Second)
+	if value, _ := s1.Get("foo"); value != "bar" {
+		t.Fatalf("key not replicated through mux (TLS %t): %q", secure, value)
+	}
+
+	resp, err := http.Get("http://" + s1.RaftBind)
+	if err != nil {
+		t.Fatalf("HTTP request failed: %s", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "http" {
+		t.Fatalf("wrong HTTP response: %s", b)
+	}
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles which may be granted to users.
+const (
+	// RoleAdmin grants access to every key, and to the operations which
+	// manage the cluster and its access control.
+	RoleAdmin = "admin"
+
+	// RoleWriter grants read and write access to every key.
+	RoleWriter = "writer"
+
+	// RoleReader grants read access to every key.
+	RoleReader = "reader"
+)
+
+var (
+	// ErrUserNotFound is returned when a user does not exist.
+	ErrUserNotFound = errors.New("user not found")
+
+	// ErrInvalidRole is returned when a user is granted a role which does
+	// not exist.
+	ErrInvalidRole = errors.New("invalid role")
+)
+
+// roleACLs are the access granted by each role.
+var roleACLs = map[string]ACL{
+	RoleAdmin:  {Admin: true},
+	RoleWriter: {Rules: []ACLRule{{Prefix: "", Read: true, Write: true}}},
+	RoleReader: {Rules: []ACLRule{{Prefix: "", Read: true}}},
+}
+
+// User is a user who authenticates with a password, and the roles granted to
+// them. The password is never stored, only its bcrypt hash.
+type User struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// ACL returns the access granted to the user by their roles.
+func (u User) ACL() ACL {
+	var acl ACL
+	for _, role := range u.Roles {
+		r := roleACLs[role]
+		acl.Admin = acl.Admin || r.Admin
+		acl.Rules = append(acl.Rules, r.Rules...)
+	}
+	return acl
+}
+
+// userRecord is a user, as stored in the FSM.
+type userRecord struct {
+	User
+	PasswordHash string `json:"password_hash"`
+}
+
+// SetUser creates, or updates, via distributed consensus, the user with the
+// given name, password and roles.
+func (s *Store) SetUser(name, password string, roles []string) error {
+	for _, role := range roles {
+		if _, ok := roleACLs[role]; !ok {
+			return fmt.Errorf("%w: %s", ErrInvalidRole, role)
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	c := &command{
+		Op:           "set_user",
+		User:         &User{Name: name, Roles: roles},
+		PasswordHash: string(hash),
+	}
+	_, err = s.apply(c)
+	return err
+}
+
+// DeleteUser deletes, via distributed consensus, the user with the given name.
+func (s *Store) DeleteUser(name string) error {
+	c := &command{
+		Op:   "delete_user",
+		User: &User{Name: name},
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// Users returns every user, in name order.
+func (s *Store) Users() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u.User)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// AuthenticateUser returns the access granted to the user with the given name,
+// if password is their password. ok is false otherwise. This node's local
+// state is used, so a password change may take effect on some nodes slightly
+// before others.
+func (s *Store) AuthenticateUser(name, password string) (acl ACL, ok bool) {
+	s.mu.Lock()
+	u, ok := s.users[name]
+	s.mu.Unlock()
+	if !ok {
+		// Compare anyway, so a missing user takes as long to reject as a
+		// wrong password.
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return ACL{}, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return ACL{}, false
+	}
+	return u.ACL(), true
+}
+
+// dummyPasswordHash returns the hash compared against when authenticating a
+// user who does not exist.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hraftd"), bcrypt.DefaultCost)
+	return hash
+})
+
+func (f *fsm) applySetUser(hash string, u User) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users[u.Name] = userRecord{User: u, PasswordHash: hash}
+	return nil
+}
+
+func (f *fsm) applyDeleteUser(name string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.users[name]; !ok {
+		return ErrUserNotFound
+	}
+	delete(f.users, name)
+	return nil
+}
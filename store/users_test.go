@@ -0,0 +1,86 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test_StoreUsers tests that users can be set, authenticated and deleted, and
+// survive a snapshot and restore.
+func Test_StoreUsers(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := os.MkdirTemp("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close(true)
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.SetUser("alice", "pw", []string{"superuser"}); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("expected invalid role, got: %v", err)
+	}
+	if err := s.SetUser("alice", "pw", []string{RoleReader}); err != nil {
+		t.Fatalf("failed to set user: %s", err)
+	}
+	acl, ok := s.AuthenticateUser("alice", "pw")
+	if !ok || !acl.CanRead("foo") || acl.CanWrite("foo") || acl.Admin {
+		t.Fatalf("user authenticated with wrong ACL: %+v", acl)
+	}
+	if _, ok := s.AuthenticateUser("alice", "wrong"); ok {
+		t.Fatalf("user authenticated with wrong password")
+	}
+	if _, ok := s.AuthenticateUser("bob", "pw"); ok {
+		t.Fatalf("missing user authenticated")
+	}
+
+	// Change the password, and the roles.
+	if err := s.SetUser("alice", "pw2", []string{RoleReader, RoleAdmin}); err != nil {
+		t.Fatalf("failed to set user: %s", err)
+	}
+	if _, ok := s.AuthenticateUser("alice", "pw"); ok {
+		t.Fatalf("user authenticated with old password")
+	}
+	if acl, ok := s.AuthenticateUser("alice", "pw2"); !ok || !acl.Admin {
+		t.Fatalf("user authenticated with wrong ACL: %+v", acl)
+	}
+	if users := s.Users(); len(users) != 1 || users[0].Name != "alice" || len(users[0].Roles) != 2 {
+		t.Fatalf("wrong users: %+v", users)
+	}
+
+	// Snapshot the store, and restore it into a new FSM.
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot store: %s", err)
+	}
+	sink := &testSnapshotSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	r := New(true)
+	if err := (*fsm)(r).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if _, ok := r.AuthenticateUser("alice", "pw2"); !ok {
+		t.Fatalf("user not restored")
+	}
+
+	if err := s.DeleteUser("alice"); err != nil {
+		t.Fatalf("failed to delete user: %s", err)
+	}
+	if err := s.DeleteUser("alice"); err != ErrUserNotFound {
+		t.Fatalf("expected user not to be found, got: %v", err)
+	}
+	if _, ok := s.AuthenticateUser("alice", "pw2"); ok {
+		t.Fatalf("deleted user authenticated")
+	}
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	watchHistorySize = 1000
+	watchBufferSize  = 100
+)
+
+// ErrCompacted is returned when a watch is requested from a log index which is
+// older than the oldest event still held in the event history.
+var ErrCompacted = errors.New("requested index is older than event history")
+
+// Event is a change to a key, made by a committed Raft log entry.
+type Event struct {
+	// Type is "set" or "delete".
+	Type string `json:"type"`
+
+	// Index is the index of the Raft log entry which made the change.
+	Index uint64 `json:"index"`
+
+	// KV is the state of the key after a set. For a delete, only the key is set.
+	KV KeyValue `json:"kv"`
+}
+
+// Watcher receives the events for a key, or all keys with a prefix.
+type Watcher interface {
+	// Events returns the channel on which events are delivered, in log order.
+	// The events of one log entry are delivered together, so once the first
+	// of them can be received, the rest can be too. The channel is closed if
+	// the watcher is closed, or if the watcher falls too far behind. In the
+	// latter case the watch should be restarted from the index after the
+	// last event received.
+	Events() <-chan Event
+
+	// Close stops the watcher.
+	Close()
+}
+
+type watcher struct {
+	key    string
+	prefix bool
+	ch     chan Event
+	hub    *watchHub
+}
+
+// Events implements Watcher.
+func (w *watcher) Events() <-chan Event {
+	return w.ch
+}
+
+// Close implements Watcher.
+func (w *watcher) Close() {
+	w.hub.remove(w)
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// watchHub keeps a bounded history of events, and delivers new events to
+// watchers.
+type watchHub struct {
+	mu       sync.Mutex
+	history  []Event
+	watchers map[*watcher]struct{}
+
+	// compacted is the highest log index for which events may be missing
+	// from the history.
+	compacted uint64
+
+	// restored is set when the history is lost due to a snapshot being
+	// restored, and the index of the snapshot is unknown, until compacted is
+	// known. Until then, a watch cannot start from any index.
+	restored bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// watch returns a watcher for the given key, or all keys with the given prefix
+// if prefix is set. Events in the history with an index at or after index are
+// delivered first. An index of 0 means only new events are delivered.
+func (h *watchHub) watch(key string, prefix bool, index uint64) (Watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if index != 0 && (h.restored || index <= h.compacted) {
+		return nil, ErrCompacted
+	}
+
+	w := &watcher{
+		key:    key,
+		prefix: prefix,
+		hub:    h,
+	}
+
+	var replay []Event
+	if index != 0 {
+		for _, ev := range h.history {
+			if ev.Index >= index && w.matches(ev.KV.Key) {
+				replay = append(replay, ev)
+			}
+		}
+	}
+	w.ch = make(chan Event, watchBufferSize+len(replay))
+	for _, ev := range replay {
+		w.ch <- ev
+	}
+
+	h.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// publish adds the events of one log entry to the history, and delivers those
+// which match to each watcher, all together. A watcher which does not have
+// room for them all is not keeping up, and is closed.
+func (h *watchHub) publish(events []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.restored {
+		h.compacted = events[0].Index - 1
+		h.restored = false
+	}
+	for _, ev := range events {
+		if len(h.history) == watchHistorySize {
+			h.compacted = h.history[0].Index
+			h.history = append(h.history[:0], h.history[1:]...)
+		}
+		h.history = append(h.history, ev)
+	}
+
+	for w := range h.watchers {
+		var matched []Event
+		for _, ev := range events {
+			if w.matches(ev.KV.Key) {
+				matched = append(matched, ev)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		// Only publish sends on the channel, so the room cannot shrink.
+		if cap(w.ch)-len(w.ch) < len(matched) {
+			delete(h.watchers, w)
+			close(w.ch)
+			continue
+		}
+		for _, ev := range matched {
+			w.ch <- ev
+		}
+	}
+}
+
+// reset discards the history, and closes all watchers. It is called when the
+// state is restored from a snapshot, since the changes leading up to that
+// state are unknown. index is the index of the last log entry in the
+// snapshot, or 0 if it is unknown, as it is for snapshots written by older
+// versions.
+func (h *watchHub) reset(index uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.history = nil
+	h.compacted = index
+	h.restored = index == 0
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+func (h *watchHub) remove(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
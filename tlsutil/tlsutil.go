@@ -0,0 +1,115 @@
+// Package tlsutil builds the TLS configurations which secure connections
+// between nodes, and to the HTTP API.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Certificate is a certificate and private key, loaded from files, which can
+// be reloaded when the files change. TLS configurations using a Certificate
+// see the reloaded certificate in every handshake after the reload.
+type Certificate struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// LoadCertificate loads the certificate in certFile, with the private key in
+// keyFile.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate again. If it cannot be loaded, the previous
+// certificate is kept.
+func (c *Certificate) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %s", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+func (c *Certificate) get() *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert
+}
+
+// ServerConfig returns a TLS configuration for accepting connections, which
+// presents cert. Client certificates are verified against the CA certificate
+// in caFile, or the system roots if caFile is empty. If verifyClient is set,
+// clients must present a certificate.
+func ServerConfig(cert *Certificate, caFile string, verifyClient bool) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.get(), nil
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+	}
+	if verifyClient {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// ClientConfig returns a TLS configuration for making connections. Server
+// certificates are verified against the CA certificate in caFile, or the
+// system roots if caFile is empty. If cert is not nil, it is presented to
+// servers which request a certificate.
+func ClientConfig(cert *Certificate, caFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if cert != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get(), nil
+		}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
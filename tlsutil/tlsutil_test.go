@@ -0,0 +1,138 @@
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/otoolep/hraftd/internal/tlstest"
+)
+
+// Test_ClientVerification tests that a server which verifies clients only
+// accepts clients with a certificate signed by its CA.
+func Test_ClientVerification(t *testing.T) {
+	files := tlstest.Write(t, t.TempDir())
+	cert, err := LoadCertificate(files.Cert, files.Key)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+	serverConfig, err := ServerConfig(cert, files.CA, true)
+	if err != nil {
+		t.Fatalf("failed to create server config: %s", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	handshake := func(config *tls.Config) error {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// The server's verdict on the client certificate arrives after the
+		// client's side of the handshake completes.
+		_, err = conn.Read(make([]byte, 1))
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+
+	clientConfig, err := ClientConfig(cert, files.CA)
+	if err != nil {
+		t.Fatalf("failed to create client config: %s", err)
+	}
+	if err := handshake(clientConfig); err != nil {
+		t.Fatalf("client with valid certificate rejected: %s", err)
+	}
+
+	clientConfig, err = ClientConfig(nil, files.CA)
+	if err != nil {
+		t.Fatalf("failed to create client config: %s", err)
+	}
+	if err := handshake(clientConfig); err == nil {
+		t.Fatalf("client without certificate accepted")
+	}
+
+	other := tlstest.Write(t, t.TempDir())
+	otherCert, err := LoadCertificate(other.Cert, other.Key)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+	clientConfig, err = ClientConfig(otherCert, other.CA)
+	if err != nil {
+		t.Fatalf("failed to create client config: %s", err)
+	}
+	if err := handshake(clientConfig); err == nil {
+		t.Fatalf("client trusting another CA accepted")
+	}
+}
+
+// Test_InvalidFiles tests that invalid certificate files are rejected.
+func Test_InvalidFiles(t *testing.T) {
+	files := tlstest.Write(t, t.TempDir())
+	if _, err := LoadCertificate(files.Cert, os.DevNull); err == nil {
+		t.Fatalf("certificate loaded with invalid key")
+	}
+	cert, err := LoadCertificate(files.Cert, files.Key)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+	if _, err := ServerConfig(cert, files.Key, false); err == nil {
+		t.Fatalf("server config created with invalid CA")
+	}
+	if _, err := ClientConfig(nil, "missing.pem"); err == nil {
+		t.Fatalf("client config created with missing CA")
+	}
+}
+
+// Test_Reload tests that a reloaded certificate is used by new handshakes, and
+// that a failed reload keeps the previous certificate.
+func Test_Reload(t *testing.T) {
+	dir := t.TempDir()
+	files := tlstest.Write(t, dir)
+	cert, err := LoadCertificate(files.Cert, files.Key)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+	config, err := ServerConfig(cert, "", false)
+	if err != nil {
+		t.Fatalf("failed to create server config: %s", err)
+	}
+	first, _ := config.GetCertificate(nil)
+
+	tlstest.Write(t, dir)
+	if err := cert.Reload(); err != nil {
+		t.Fatalf("failed to reload certificate: %s", err)
+	}
+	second, _ := config.GetCertificate(nil)
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Fatalf("certificate not reloaded")
+	}
+
+	if err := os.WriteFile(files.Key, nil, 0o600); err != nil {
+		t.Fatalf("failed to truncate key: %s", err)
+	}
+	if err := cert.Reload(); err == nil {
+		t.Fatalf("invalid certificate reloaded")
+	}
+	if third, _ := config.GetCertificate(nil); third != second {
+		t.Fatalf("certificate changed by failed reload")
+	}
+}